@@ -3,7 +3,9 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
@@ -61,6 +63,52 @@ type AcceptOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionMinSavings is the number of bytes compression must save for
+	// a message written with Write to be sent compressed. Messages that do not
+	// compress well enough, such as already compressed media, are sent
+	// uncompressed instead.
+	//
+	// Defaults to 0 which sends a message compressed whenever that makes it smaller.
+	// Messages written with Writer are always compressed once over the threshold.
+	CompressionMinSavings int
+
+	// DisableFinalizer disables the finalizer that closes the connection
+	// if it is garbage collected without Close being called.
+	//
+	// The finalizer guards against leaking the underlying connection but adds
+	// GC overhead per connection and can hide missing Close calls. Only disable
+	// it if every connection is reliably closed.
+	DisableFinalizer bool
+
+	// MemoryLimiter bounds the memory used to read messages across all connections
+	// sharing it. See the docs on MemoryLimiter.
+	MemoryLimiter *MemoryLimiter
+
+	// Role restricts the connection to reading or writing messages for endpoints
+	// that only do one or the other. See the docs on Role.
+	//
+	// Defaults to RoleDuplex.
+	Role Role
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers used to
+	// read from and write to the underlying connection.
+	//
+	// Larger buffers reduce the number of syscalls for high throughput streams
+	// at the cost of memory held by every connection for its lifetime.
+	//
+	// Both default to the sizes of the buffers returned by http.Hijacker,
+	// 4096 with net/http.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// ValidateRequest is called with the upgrade request after the handshake
+	// and origin have been verified but before the response is written.
+	// Use it to enforce custom policy on handshake headers such as an API version.
+	//
+	// If it returns an error, the request is rejected with the returned status code
+	// and the error as the body. The status code defaults to http.StatusForbidden.
+	ValidateRequest func(r *http.Request) (status int, err error)
 }
 
 // Accept accepts a WebSocket handshake from a client and upgrades the
@@ -70,10 +118,26 @@ type AcceptOptions struct {
 // See the InsecureSkipVerify and OriginPatterns options to allow cross origin requests.
 //
 // Accept will write a response to w on all errors.
+//
+// The request has already been read by net/http when Accept is called so
+// Accept cannot bound how long a client takes to send it. Set
+// http.Server.ReadHeaderTimeout to cut off clients that send the request
+// headers slowly.
 func Accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (*Conn, error) {
 	return accept(w, r, opts)
 }
 
+// IsWebSocketUpgrade reports whether r is a request to upgrade to the
+// WebSocket protocol.
+//
+// Use it to serve WebSocket and regular HTTP requests from the same handler.
+// It only checks the Connection and Upgrade headers so Accept may
+// still reject the request if the rest of the handshake is invalid.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "Upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
 func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Conn, err error) {
 	defer errd.Wrap(&err, "failed to accept WebSocket connection")
 
@@ -100,6 +164,17 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		}
 	}
 
+	if opts.ValidateRequest != nil {
+		status, err := opts.ValidateRequest(r)
+		if err != nil {
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return nil, fmt.Errorf("request rejected: %w", err)
+		}
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		err = errors.New("http.ResponseWriter does not implement http.Hijacker")
@@ -140,18 +215,48 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 
 	// https://github.com/golang/go/issues/32314
 	b, _ := brw.Reader.Peek(brw.Reader.Buffered())
-	brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), netConn))
-
-	return newConn(connConfig{
-		subprotocol:    w.Header().Get("Sec-WebSocket-Protocol"),
-		rwc:            netConn,
-		client:         false,
-		copts:          copts,
-		flateThreshold: opts.CompressionThreshold,
-
-		br: brw.Reader,
-		bw: brw.Writer,
-	}), nil
+	rd := io.MultiReader(bytes.NewReader(b), netConn)
+	br := brw.Reader
+	if opts.ReadBufferSize > 0 && opts.ReadBufferSize != br.Size() {
+		br = bufio.NewReaderSize(rd, opts.ReadBufferSize)
+	} else {
+		br.Reset(rd)
+	}
+
+	bw := brw.Writer
+	if opts.WriteBufferSize > 0 && opts.WriteBufferSize != bw.Size() {
+		// The handshake response may still be buffered.
+		err = bw.Flush()
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("failed to flush handshake response: %w", err)
+		}
+		bw = bufio.NewWriterSize(netConn, opts.WriteBufferSize)
+	}
+
+	c := newConn(connConfig{
+		subprotocol:         w.Header().Get("Sec-WebSocket-Protocol"),
+		offeredSubprotocols: headerTokens(r.Header, "Sec-WebSocket-Protocol"),
+		extensions:          w.Header().Get("Sec-WebSocket-Extensions"),
+		url:                 r.URL,
+		rwc:                 netConn,
+		client:              false,
+		copts:               copts,
+		flateThreshold:      opts.CompressionThreshold,
+		flateMinSavings:     opts.CompressionMinSavings,
+		memLimiter:          opts.MemoryLimiter,
+		noFinalizer:         opts.DisableFinalizer,
+		role:                opts.Role,
+
+		br: br,
+		bw: bw,
+	})
+	if opts.Role == RoleWriteOnly {
+		// A data message to a write only connection breaks the protocol
+		// the application negotiated rather than a policy of ours.
+		c.closeRead(context.Background(), StatusProtocolError)
+	}
+	return c, nil
 }
 
 func verifyClientRequest(w http.ResponseWriter, r *http.Request) (errCode int, _ error) {
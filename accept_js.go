@@ -7,11 +7,18 @@ import (
 
 // AcceptOptions represents Accept's options.
 type AcceptOptions struct {
-	Subprotocols         []string
-	InsecureSkipVerify   bool
-	OriginPatterns       []string
-	CompressionMode      CompressionMode
-	CompressionThreshold int
+	Subprotocols          []string
+	InsecureSkipVerify    bool
+	OriginPatterns        []string
+	CompressionMode       CompressionMode
+	CompressionThreshold  int
+	CompressionMinSavings int
+	DisableFinalizer      bool
+	MemoryLimiter         *MemoryLimiter
+	Role                  Role
+	ReadBufferSize        int
+	WriteBufferSize       int
+	ValidateRequest       func(r *http.Request) (status int, err error)
 }
 
 // Accept is stubbed out for Wasm.
@@ -42,6 +42,29 @@ func TestAccept(t *testing.T) {
 		assert.Contains(t, err, `request Origin "harhar.com" is not authorized for Host`)
 	})
 
+	t.Run("validateRequest", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "meow123")
+
+		_, err := Accept(w, r, &AcceptOptions{
+			ValidateRequest: func(r *http.Request) (int, error) {
+				if r.Header.Get("X-API-Version") != "2" {
+					return http.StatusPreconditionFailed, errors.New("unsupported API version")
+				}
+				return 0, nil
+			},
+		})
+		assert.Contains(t, err, "request rejected: unsupported API version")
+		assert.Equal(t, "status code", http.StatusPreconditionFailed, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported API version")
+	})
+
 	t.Run("badCompression", func(t *testing.T) {
 		t.Parallel()
 
@@ -191,6 +214,55 @@ func Test_verifyClientHandshake(t *testing.T) {
 	}
 }
 
+func TestIsWebSocketUpgrade(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		h       map[string]string
+		upgrade bool
+	}{
+		{
+			name: "plainHTTP",
+		},
+		{
+			name: "otherUpgrade",
+			h: map[string]string{
+				"Connection": "Upgrade",
+				"Upgrade":    "h2c",
+			},
+		},
+		{
+			name: "missingConnection",
+			h: map[string]string{
+				"Upgrade": "websocket",
+			},
+		},
+		{
+			name: "upgrade",
+			h: map[string]string{
+				"Connection": "keep-alive, Upgrade",
+				"Upgrade":    "WebSocket",
+			},
+			upgrade: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tc.h {
+				r.Header.Set(k, v)
+			}
+
+			assert.Equal(t, "upgrade", tc.upgrade, IsWebSocketUpgrade(r))
+		})
+	}
+}
+
 func Test_selectSubprotocol(t *testing.T) {
 	t.Parallel()
 
@@ -224,6 +296,12 @@ func Test_selectSubprotocol(t *testing.T) {
 			serverProtocols: []string{"echo2", "echo3"},
 			negotiated:      "echo3",
 		},
+		{
+			name:            "serverPreference",
+			clientProtocols: []string{"a", "b", "c"},
+			serverProtocols: []string{"c", "a"},
+			negotiated:      "c",
+		},
 	}
 
 	for _, tc := range testCases {
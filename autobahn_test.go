@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strconv"
@@ -22,10 +23,6 @@ import (
 )
 
 var excludedAutobahnCases = []string{
-	// We skip the UTF-8 handling tests as there isn't any reason to reject invalid UTF-8, just
-	// more performance overhead.
-	"6.*", "7.5.1",
-
 	// We skip the tests related to requestMaxWindowBits as that is unimplemented due
 	// to limitations in compress/flate. See https://github.com/golang/go/issues/3155
 	// Same with klauspost/compress which doesn't allow adjusting the sliding window size.
@@ -63,6 +60,7 @@ func TestAutobahn(t *testing.T) {
 
 				c, _, err := websocket.Dial(ctx, fmt.Sprintf(wstestURL+"/runCase?case=%v&agent=main", i), nil)
 				assert.Success(t, err)
+				c.SetUTF8Validation(true)
 				err = wstest.EchoLoop(ctx, c)
 				t.Logf("echoLoop: %v", err)
 			})
@@ -76,6 +74,47 @@ func TestAutobahn(t *testing.T) {
 	checkWSTestIndex(t, "./ci/out/wstestClientReports/index.json")
 }
 
+// TestAutobahnServer runs the Autobahn fuzzingclient against wstest.EchoServer
+// to test the server side. It writes its reports to ci/out/wstestServerReports.
+//
+// To run the fuzzingclient by hand, serve wstest.EchoServer and list its URL
+// in the servers of the spec passed to wstest --mode fuzzingclient.
+func TestAutobahnServer(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("AUTOBAHN_TEST") == "" {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*15)
+	defer cancel()
+
+	s := httptest.NewServer(wstest.EchoServer(&websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+	}))
+	defer s.Close()
+
+	specFile, err := tempJSONFile(map[string]interface{}{
+		"outdir": "ci/out/wstestServerReports",
+		"servers": []interface{}{
+			map[string]interface{}{
+				"agent": "main",
+				"url":   strings.Replace(s.URL, "http", "ws", 1),
+			},
+		},
+		"cases":         autobahnCases,
+		"exclude-cases": excludedAutobahnCases,
+	})
+	assert.Success(t, err)
+
+	out, err := exec.CommandContext(ctx, "wstest", "--mode", "fuzzingclient", "--spec", specFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to run wstest: %v\n%s", err, out)
+	}
+
+	checkWSTestIndex(t, "./ci/out/wstestServerReports/index.json")
+}
+
 func waitWS(ctx context.Context, url string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
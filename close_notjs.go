@@ -7,8 +7,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"time"
+	"unicode/utf8"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -17,108 +17,329 @@ import (
 //
 // It will write a WebSocket close frame with a timeout of 5s and then wait 5s for
 // the peer to send a close frame.
+//
 // All data messages received from the peer during the close handshake will be discarded.
+// Reader and Read calls, including those already waiting for a message, discard
+// them as well and return the peer's close frame as a CloseError once it arrives
+// or the error that ended the handshake. Only a message that was already being
+// read when Close was called is read to completion. Pings received during the
+// handshake are not answered as nothing may be written after the close frame.
 //
 // The connection can only be closed once. Additional calls to Close
 // are no-ops.
 //
+// If both peers close at the same time, the handshake completes as usual.
+// Whichever close frame was first, the one we began writing or the one we
+// received, determines the error returned by all other methods from then on.
+// Only in the latter case does it match ErrPeerClosed.
+//
 // The maximum length of reason must be 125 bytes. Avoid
 // sending a dynamic reason.
 //
 // Close will unblock all goroutines interacting with the connection once
 // complete.
 func (c *Conn) Close(code StatusCode, reason string) error {
-	return c.closeHandshake(code, reason)
+	return c.closeHandshake(context.Background(), code, func() error {
+		return c.writeClose(context.Background(), code, reason)
+	})
 }
 
-func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
+// WriteClose is like Close but sends p as the payload of the close frame
+// as is instead of marshalling a status code and reason. Use it for protocols
+// that define their own close payloads. The passed ctx bounds writing the
+// close frame.
+//
+// p must be at most 125 bytes and, if not empty, begin with a valid status
+// code. An error is returned without closing the connection otherwise.
+func (c *Conn) WriteClose(ctx context.Context, p []byte) error {
+	if len(p) > maxControlPayload {
+		return fmt.Errorf("failed to close WebSocket: close payload of %v bytes exceeds the maximum of %v bytes", len(p), maxControlPayload)
+	}
+	ce, err := parseClosePayload(p)
+	if err != nil {
+		return fmt.Errorf("failed to close WebSocket: invalid close payload: %w", err)
+	}
+
+	return c.closeHandshake(context.Background(), ce.Code, func() error {
+		err := c.beginWriteClose(ce)
+		if err != nil {
+			return err
+		}
+		return c.writeClosePayload(ctx, p)
+	})
+}
+
+// Drain gracefully closes the connection for shutdown. It stops new messages
+// from being written, waits for the message being written to complete and
+// then performs the close handshake with StatusNormalClosure.
+//
+// Writers requested once Drain has been called block until the connection
+// is closed and then fail. Readers are unaffected until the close handshake.
+//
+// ctx bounds waiting for the message being written and for the peer's close
+// frame. Without a deadline, the peer's close frame is waited for up to 5s
+// as with Close.
+func (c *Conn) Drain(ctx context.Context) error {
+	// Never unlocked as no more messages may be written.
+	err := c.msgWriterState.mu.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to drain: %w", err)
+	}
+
+	return c.closeHandshake(ctx, StatusNormalClosure, func() error {
+		return c.writeClose(context.Background(), StatusNormalClosure, "")
+	})
+}
+
+func (c *Conn) closeHandshake(ctx context.Context, code StatusCode, writeClose func() error) (err error) {
 	defer errd.Wrap(&err, "failed to close WebSocket")
 
-	writeErr := c.writeClose(code, reason)
-	closeHandshakeErr := c.waitCloseHandshake()
+	writeErr := writeClose()
+	if errors.Is(writeErr, errAlreadyWroteClose) {
+		// Whoever is writing the close frame closes the connection once it
+		// has been written. Closing before then could cut it off.
+		<-c.closed
+	}
+	receivedClose, closeHandshakeErr := c.waitCloseHandshake(ctx)
 
-	if writeErr != nil {
-		return writeErr
+	sentClose := writeErr == nil || errors.Is(writeErr, errAlreadyWroteClose)
+	if sentClose && receivedClose && CloseStatus(closeHandshakeErr) != -1 {
+		return nil
 	}
 
-	if CloseStatus(closeHandshakeErr) == -1 {
-		return closeHandshakeErr
+	che := CloseHandshakeError{
+		SentClose:     sentClose,
+		SentCode:      code,
+		ReceivedClose: receivedClose,
+		ReceivedCode:  -1,
+		Err:           writeErr,
+	}
+	if receivedClose {
+		che.ReceivedCode = CloseStatus(closeHandshakeErr)
+	}
+	if che.Err == nil {
+		che.Err = closeHandshakeErr
 	}
+	return che
+}
 
-	return nil
+// SetCloseReasonFunc sets a function that returns the reason sent to the peer
+// when the connection is closed because of an error, such as the read limit
+// being hit or a protocol violation by the peer. It is called with the status
+// code being sent and the error. Use it to include a support code or correlation
+// ID that clients can report.
+//
+// Reasons longer than 123 bytes are truncated.
+// By default, the error string is sent as the reason.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetCloseReasonFunc(fn func(code StatusCode, err error) string) {
+	c.closeReasonFunc = fn
 }
 
-var errAlreadyWroteClose = errors.New("already wrote close")
+// SetCloseHandler sets a function that is called with the peer's close frame
+// when it is received, before the close frame is echoed and the connection
+// torn down. Use it for cleanup or metrics keyed on the peer's status code
+// and reason.
+//
+// It is called from the goroutine reading the connection so it must not
+// block or read from the connection.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetCloseHandler(fn func(CloseError)) {
+	c.closeHandler = fn
+}
 
-func (c *Conn) writeClose(code StatusCode, reason string) error {
-	c.closeMu.Lock()
-	wroteClose := c.wroteClose
-	c.wroteClose = true
-	c.closeMu.Unlock()
-	if wroteClose {
-		return errAlreadyWroteClose
-	}
+// CloseHandshakeError is returned by Close when the close handshake
+// did not complete cleanly. It describes how far the handshake got.
+//
+// Use Go 1.13's errors.As to check for this error.
+type CloseHandshakeError struct {
+	// SentClose is whether our close frame was written to the peer.
+	SentClose bool
+	// SentCode is the status code passed to Close.
+	SentCode StatusCode
+
+	// ReceivedClose is whether a close frame was received from the peer.
+	ReceivedClose bool
+	// ReceivedCode is the status code in the peer's close frame.
+	// It is -1 if no close frame was received or its payload was invalid.
+	ReceivedCode StatusCode
+
+	// Err is the error that interrupted the handshake.
+	Err error
+}
+
+func (che CloseHandshakeError) Error() string {
+	return fmt.Sprintf("close handshake incomplete (sent close = %v with %v, received close = %v with %v): %v",
+		che.SentClose, che.SentCode, che.ReceivedClose, che.ReceivedCode, che.Err,
+	)
+}
+
+// Unwrap returns the error that interrupted the handshake.
+func (che CloseHandshakeError) Unwrap() error {
+	return che.Err
+}
+
+// ErrPeerClosed is returned by all methods once the peer has sent a close frame.
+// Use errors.Is to check for it. The returned error also wraps the peer's
+// CloseError.
+//
+// It distinguishes a close initiated by the peer from transport errors
+// and closes initiated by us.
+var ErrPeerClosed = errors.New("peer closed the connection")
+
+// peerCloseError wraps the CloseError received from the peer
+// so that it matches ErrPeerClosed.
+type peerCloseError struct {
+	ce CloseError
+}
+
+func (e peerCloseError) Error() string {
+	return e.ce.Error()
+}
+
+func (e peerCloseError) Unwrap() error {
+	return e.ce
+}
+
+func (e peerCloseError) Is(target error) bool {
+	return target == ErrPeerClosed
+}
 
+// ErrProtocolViolation is returned by all methods once the connection has
+// been closed because the peer violated the WebSocket protocol, such as by
+// sending a frame with reserved bits or opcodes set. Use errors.Is to check
+// for it.
+//
+// It distinguishes a buggy or malicious peer from a normal shutdown.
+var ErrProtocolViolation = errors.New("peer violated the protocol")
+
+// protocolViolationError wraps an error describing how the peer violated
+// the protocol so that it matches ErrProtocolViolation.
+type protocolViolationError struct {
+	err error
+}
+
+func (e protocolViolationError) Error() string {
+	return e.err.Error()
+}
+
+func (e protocolViolationError) Unwrap() error {
+	return e.err
+}
+
+func (e protocolViolationError) Is(target error) bool {
+	return target == ErrProtocolViolation
+}
+
+var errAlreadyWroteClose = errors.New("already wrote close")
+
+func (c *Conn) writeClose(ctx context.Context, code StatusCode, reason string) error {
 	ce := CloseError{
 		Code:   code,
 		Reason: reason,
 	}
 
+	err := c.beginWriteClose(ce)
+	if err != nil {
+		return err
+	}
+
 	var p []byte
 	var marshalErr error
 	if ce.Code != StatusNoStatusRcvd {
 		p, marshalErr = ce.bytes()
 		if marshalErr != nil {
-			log.Printf("websocket: %v", marshalErr)
+			c.warnf("websocket: %v", marshalErr)
 		}
 	}
 
-	writeErr := c.writeControl(context.Background(), opClose, p)
-	if CloseStatus(writeErr) != -1 {
-		// Not a real error if it's due to a close frame being received.
-		writeErr = nil
-	}
-
-	// We do this after in case there was an error writing the close frame.
-	c.setCloseErr(fmt.Errorf("sent close frame: %w", ce))
-
+	writeErr := c.writeClosePayload(ctx, p)
 	if marshalErr != nil {
 		return marshalErr
 	}
 	return writeErr
 }
 
-func (c *Conn) waitCloseHandshake() error {
+// beginWriteClose records that a close frame for ce is about to be written.
+// It returns errAlreadyWroteClose if one already has been.
+func (c *Conn) beginWriteClose(ce CloseError) error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.wroteClose {
+		return errAlreadyWroteClose
+	}
+	c.wroteClose = true
+	// Set before writing so that if the peer's close frame is received
+	// while ours is being written, the close error still reflects that
+	// we closed first. See handleControl.
+	c.setCloseErrLocked(fmt.Errorf("sent close frame: %w", ce))
+	return nil
+}
+
+func (c *Conn) writeClosePayload(ctx context.Context, p []byte) error {
+	err := c.writeControl(ctx, opClose, p)
+	if CloseStatus(err) != -1 {
+		// Not a real error if it's due to a close frame being received.
+		return nil
+	}
+	return err
+}
+
+// waitCloseHandshake waits for the peer's close frame for up to 5s
+// unless ctx has a deadline. It reports whether the close frame was received.
+func (c *Conn) waitCloseHandshake(ctx context.Context) (bool, error) {
 	defer c.close(nil)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+	}
 
 	err := c.readMu.lock(ctx)
+	if readCloseFrameErr := c.getReadCloseFrameErr(); readCloseFrameErr != nil {
+		if err == nil {
+			c.readMu.unlock()
+		}
+		return true, readCloseFrameErr
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer c.readMu.unlock()
 
-	if c.readCloseFrameErr != nil {
-		return c.readCloseFrameErr
-	}
-
 	for {
 		h, err := c.readLoop(ctx)
 		if err != nil {
-			return err
+			return c.getReadCloseFrameErr() != nil, err
 		}
 
-		for i := int64(0); i < h.payloadLength; i++ {
-			_, err := c.br.ReadByte()
-			if err != nil {
-				return err
-			}
+		err = c.discardFramePayload(ctx, h)
+		if err != nil {
+			return false, err
 		}
 	}
 }
 
+// wroteCloseFrame reports whether our close frame has been written
+// or is being written.
+func (c *Conn) wroteCloseFrame() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.wroteClose
+}
+
+// getReadCloseFrameErr returns the error from handling the peer's close frame
+// or nil if none has been received.
+func (c *Conn) getReadCloseFrameErr() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.readCloseFrameErr
+}
+
 func parseClosePayload(p []byte) (CloseError, error) {
 	if len(p) == 0 {
 		return CloseError{
@@ -174,6 +395,19 @@ func (ce CloseError) bytes() ([]byte, error) {
 
 const maxCloseReason = maxControlPayload - 2
 
+// truncateCloseReason truncates reason to maxCloseReason bytes
+// without splitting a UTF-8 encoded rune.
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for len(reason) > 0 && !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
+
 func (ce CloseError) bytesErr() ([]byte, error) {
 	if len(ce.Reason) > maxCloseReason {
 		return nil, fmt.Errorf("reason string max is %v but got %q with length %v", maxCloseReason, ce.Reason, len(ce.Reason))
@@ -168,6 +168,47 @@ func Test_validWireCloseCode(t *testing.T) {
 	}
 }
 
+func Test_truncateCloseReason(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		reason string
+		exp    string
+	}{
+		{
+			name:   "short",
+			reason: "meow",
+			exp:    "meow",
+		},
+		{
+			name:   "max",
+			reason: strings.Repeat("x", maxCloseReason),
+			exp:    strings.Repeat("x", maxCloseReason),
+		},
+		{
+			name:   "long",
+			reason: strings.Repeat("x", maxCloseReason+10),
+			exp:    strings.Repeat("x", maxCloseReason),
+		},
+		{
+			name:   "splitRune",
+			reason: strings.Repeat("x", maxCloseReason-1) + "é",
+			exp:    strings.Repeat("x", maxCloseReason-1),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			act := truncateCloseReason(tc.reason)
+			assert.Equal(t, "close reason", tc.exp, act)
+		})
+	}
+}
+
 func TestCloseStatus(t *testing.T) {
 	t.Parallel()
 
@@ -1,5 +1,9 @@
 package websocket
 
+import (
+	"fmt"
+)
+
 // MessageType represents the type of a WebSocket message.
 // See https://tools.ietf.org/html/rfc6455#section-5.6
 type MessageType int
@@ -11,3 +15,39 @@ const (
 	// MessageBinary is for binary messages like protobufs.
 	MessageBinary
 )
+
+// valid reports whether t is one of the MessageType constants.
+func (t MessageType) valid() bool {
+	return t == MessageText || t == MessageBinary
+}
+
+// Role restricts the direction in which messages may flow on a connection.
+type Role int
+
+// Role constants.
+const (
+	// RoleDuplex allows both reading and writing messages.
+	// It is the default.
+	RoleDuplex Role = iota
+	// RoleReadOnly disallows writing messages.
+	// Control frames are still written as usual.
+	RoleReadOnly
+	// RoleWriteOnly disallows reading messages.
+	// Control frames are read in the background as with CloseRead and
+	// the connection is closed with StatusProtocolError if the peer
+	// sends a data message.
+	RoleWriteOnly
+)
+
+// ReadLimitError is returned when a message read exceeds the limit
+// set with SetReadLimit or the max passed to ReadFull. The connection
+// is closed with StatusMessageTooBig.
+//
+// Use errors.As to tell it apart from other read errors.
+type ReadLimitError struct {
+	Limit int64
+}
+
+func (e ReadLimitError) Error() string {
+	return fmt.Sprintf("read limited at %v bytes", e.Limit)
+}
@@ -5,13 +5,20 @@ package websocket
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
+	"net/url"
 	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 // Conn represents a WebSocket connection.
@@ -26,23 +33,51 @@ import (
 // On any error from any method, the connection is closed
 // with an appropriate reason.
 type Conn struct {
-	subprotocol    string
-	rwc            io.ReadWriteCloser
-	client         bool
-	copts          *compressionOptions
-	flateThreshold int
-	br             *bufio.Reader
-	bw             *bufio.Writer
+	subprotocol         string
+	offeredSubprotocols []string
+	extensions          string
+	url                 *url.URL
+	rwc                 io.ReadWriteCloser
+	client              bool
+	maskRand            io.Reader
+	copts               *compressionOptions
+	flateThreshold      int
+	flateMinSavings     int
+	memLimiter          *MemoryLimiter
+	role                Role
+	readSizes           *SizeHistogram
+	writeSizes          *SizeHistogram
+	onReadFrame         func(FrameTrace)
+	onWriteFrame        func(FrameTrace)
+	br                  *bufio.Reader
+	bw                  *bufio.Writer
 
 	readTimeout  chan context.Context
 	writeTimeout chan context.Context
+	// writerTimeout bounds the Writer returned to the application.
+	writerTimeout chan context.Context
+
+	defaultReadTimeout  xsync.Int64
+	defaultWriteTimeout xsync.Int64
+	controlWriteTimeout xsync.Int64
+	// Unix nanoseconds or 0 for no deadline.
+	readDeadline  xsync.Int64
+	writeDeadline xsync.Int64
 
 	// Read state.
-	readMu            *mu
-	readHeaderBuf     [8]byte
-	readControlBuf    [maxControlPayload]byte
-	msgReader         *msgReader
-	readCloseFrameErr error
+	readMu         *mu
+	readHeaderBuf  [8]byte
+	readControlBuf [maxControlPayload]byte
+	msgReader      *msgReader
+	msgFilter      func(MessageHeader) error
+	validateUTF8   bool
+	errorLog       *log.Logger
+
+	controlLimit       xsync.Int64
+	controlCount       xsync.Int64
+	controlWindowStart xsync.Int64 // Unix nanoseconds.
+
+	rejectedControlHandler func(error)
 
 	// Write state.
 	msgWriterState *msgWriterState
@@ -50,46 +85,96 @@ type Conn struct {
 	writeBuf       []byte
 	writeHeaderBuf [8]byte
 	writeHeader    header
-
-	closed     chan struct{}
-	closeMu    sync.Mutex
-	closeErr   error
-	wroteClose bool
-
-	pingCounter   int32
-	activePingsMu sync.Mutex
-	activePings   map[string]chan<- struct{}
+	rawMsgOpen     bool
+
+	writeBacklogMu    sync.Mutex
+	writeBacklog      int
+	writeHighWater    int
+	writeBacklogBlock bool
+	// writeBacklogFreed is closed when writeBacklog shrinks
+	// to wake blocked writes.
+	writeBacklogFreed chan struct{}
+
+	closed            chan struct{}
+	closeMu           sync.Mutex
+	closeErr          error
+	wroteClose        bool
+	readCloseFrameErr error
+	closeReasonFunc   func(StatusCode, error) string
+	closeHandler      func(CloseError)
+
+	// In its own allocation so that the counters are 64 bit aligned
+	// for atomic operations on 32 bit platforms.
+	stats *Stats
+
+	pingCounter    int32
+	activePingsMu  sync.Mutex
+	activePings    map[string]chan<- struct{}
+	coalescedPongs bool
+	pongHandler    func(payload []byte)
+	touch          chan struct{}
 }
 
 type connConfig struct {
-	subprotocol    string
-	rwc            io.ReadWriteCloser
-	client         bool
-	copts          *compressionOptions
-	flateThreshold int
+	subprotocol         string
+	offeredSubprotocols []string
+	extensions          string
+	url                 *url.URL
+	rwc                 io.ReadWriteCloser
+	client              bool
+	maskRand            io.Reader
+	copts               *compressionOptions
+	flateThreshold      int
+	flateMinSavings     int
+	memLimiter          *MemoryLimiter
+	noFinalizer         bool
+	role                Role
 
 	br *bufio.Reader
 	bw *bufio.Writer
 }
 
+// timeoutChanBuffer is the buffer size of the channels used to hand
+// contexts to timeoutLoop. Each frame read or written sends two contexts.
+const timeoutChanBuffer = 4
+
 func newConn(cfg connConfig) *Conn {
 	c := &Conn{
-		subprotocol:    cfg.subprotocol,
-		rwc:            cfg.rwc,
-		client:         cfg.client,
-		copts:          cfg.copts,
-		flateThreshold: cfg.flateThreshold,
+		subprotocol:         cfg.subprotocol,
+		offeredSubprotocols: cfg.offeredSubprotocols,
+		extensions:          cfg.extensions,
+		url:                 cfg.url,
+		rwc:                 cfg.rwc,
+		client:              cfg.client,
+		maskRand:            cfg.maskRand,
+		copts:               cfg.copts,
+		flateThreshold:      cfg.flateThreshold,
+		flateMinSavings:     cfg.flateMinSavings,
+		memLimiter:          cfg.memLimiter,
+		role:                cfg.role,
 
 		br: cfg.br,
 		bw: cfg.bw,
 
-		readTimeout:  make(chan context.Context),
-		writeTimeout: make(chan context.Context),
+		// Buffered so that reads and writes do not have to wait for
+		// timeoutLoop to wake up for every frame. The contexts are still
+		// received in order so a blocked read or write is always bounded
+		// by its context.
+		readTimeout:   make(chan context.Context, timeoutChanBuffer),
+		writeTimeout:  make(chan context.Context, timeoutChanBuffer),
+		writerTimeout: make(chan context.Context, timeoutChanBuffer),
 
 		closed:      make(chan struct{}),
 		activePings: make(map[string]chan<- struct{}),
+		touch:       make(chan struct{}, 1),
+		stats:       &Stats{},
 	}
 
+	if c.maskRand == nil {
+		c.maskRand = rand.Reader
+	}
+	c.SetControlWriteTimeout(0)
+
 	c.readMu = newMu(c)
 	c.writeFrameMu = newMu(c)
 
@@ -107,9 +192,11 @@ func newConn(cfg connConfig) *Conn {
 		}
 	}
 
-	runtime.SetFinalizer(c, func(c *Conn) {
-		c.close(errors.New("connection garbage collected"))
-	})
+	if !cfg.noFinalizer {
+		runtime.SetFinalizer(c, func(c *Conn) {
+			c.close(errors.New("connection garbage collected"))
+		})
+	}
 
 	go c.timeoutLoop()
 
@@ -122,6 +209,166 @@ func (c *Conn) Subprotocol() string {
 	return c.subprotocol
 }
 
+// OfferedSubprotocols returns the subprotocols the client offered in its
+// handshake request in order of preference. It is nil for a client
+// connection.
+func (c *Conn) OfferedSubprotocols() []string {
+	return append([]string(nil), c.offeredSubprotocols...)
+}
+
+// SetSizeHistograms sets the histograms that the sizes of messages read
+// and written are recorded in. Either may be nil to disable recording.
+//
+// Sizes are of the message payload before compression. Messages written
+// with WriteRaw are not recorded.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetSizeHistograms(read, written *SizeHistogram) {
+	c.readSizes = read
+	c.writeSizes = written
+}
+
+// SetFrameHooks sets functions that are called with the header of every
+// frame read and written, including control frames. Either may be nil.
+// They are meant for debugging framing issues, such as by logging every
+// frame with %+v.
+//
+// The functions are called synchronously while reading or writing so they
+// must be fast and must not use the connection.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetFrameHooks(onRead, onWrite func(FrameTrace)) {
+	c.onReadFrame = onRead
+	c.onWriteFrame = onWrite
+}
+
+// ConnInfo describes what was negotiated during the handshake of a connection.
+type ConnInfo struct {
+	// Subprotocol is the negotiated subprotocol.
+	Subprotocol string
+	// Extensions is the negotiated Sec-WebSocket-Extensions header.
+	Extensions string
+	// CompressionMode is the negotiated compression mode for messages written
+	// by this side of the connection.
+	CompressionMode CompressionMode
+	// CompressionThreshold is the minimum size of a message before it is compressed.
+	CompressionThreshold int
+	// Client is whether this side of the connection dialed.
+	Client bool
+	// LocalAddr and RemoteAddr are the addresses of the underlying connection.
+	// They are nil if the connection does not expose them.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// URL is the URL of the handshake request.
+	URL *url.URL
+}
+
+// Info returns the ConnInfo of the connection.
+// It is convenient for logging a connection once it has been established.
+func (c *Conn) Info() ConnInfo {
+	ci := ConnInfo{
+		Subprotocol:     c.subprotocol,
+		Extensions:      c.extensions,
+		CompressionMode: CompressionDisabled,
+		Client:          c.client,
+		URL:             c.url,
+	}
+	if c.flate() {
+		ci.CompressionMode = CompressionNoContextTakeover
+		if c.msgWriterState.flateContextTakeover() {
+			ci.CompressionMode = CompressionContextTakeover
+		}
+		ci.CompressionThreshold = c.flateThreshold
+	}
+	if addrs, ok := c.rwc.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	}); ok {
+		ci.LocalAddr = addrs.LocalAddr()
+		ci.RemoteAddr = addrs.RemoteAddr()
+	}
+	return ci
+}
+
+// Stats is a snapshot of the counters of a connection.
+type Stats struct {
+	// MessagesRead and MessagesWritten count complete data messages.
+	MessagesRead    int64
+	MessagesWritten int64
+
+	// BytesRead and BytesWritten count the payload bytes of all frames
+	// as they are on the wire. That is after compression and without
+	// frame headers.
+	BytesRead    int64
+	BytesWritten int64
+
+	// CompressedBytesRead and CompressedBytesWritten count the payload bytes
+	// of messages compressed with permessage-deflate as they are on the wire.
+	// UncompressedBytesRead and UncompressedBytesWritten count the bytes of
+	// the same messages before compression so that their ratio measures how
+	// effective compression is. Frames read with ReadRaw or written with
+	// WriteRaw are not counted.
+	CompressedBytesRead      int64
+	CompressedBytesWritten   int64
+	UncompressedBytesRead    int64
+	UncompressedBytesWritten int64
+
+	// PingsSent counts the pings sent by Ping.
+	PingsSent int64
+	// PongsReceived counts all pongs received.
+	PongsReceived int64
+}
+
+// Stats returns a snapshot of the connection's counters.
+// It is safe to call concurrently with all other methods.
+func (c *Conn) Stats() Stats {
+	return Stats{
+		MessagesRead:             atomic.LoadInt64(&c.stats.MessagesRead),
+		MessagesWritten:          atomic.LoadInt64(&c.stats.MessagesWritten),
+		BytesRead:                atomic.LoadInt64(&c.stats.BytesRead),
+		BytesWritten:             atomic.LoadInt64(&c.stats.BytesWritten),
+		CompressedBytesRead:      atomic.LoadInt64(&c.stats.CompressedBytesRead),
+		CompressedBytesWritten:   atomic.LoadInt64(&c.stats.CompressedBytesWritten),
+		UncompressedBytesRead:    atomic.LoadInt64(&c.stats.UncompressedBytesRead),
+		UncompressedBytesWritten: atomic.LoadInt64(&c.stats.UncompressedBytesWritten),
+		PingsSent:                atomic.LoadInt64(&c.stats.PingsSent),
+		PongsReceived:            atomic.LoadInt64(&c.stats.PongsReceived),
+	}
+}
+
+// Done returns a channel that is closed once the connection is closed.
+// Use it to react to the connection closing alongside other events.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// IsClosed reports whether the connection has been closed
+// without blocking or performing any I/O.
+func (c *Conn) IsClosed() bool {
+	return c.isClosed()
+}
+
+// Err returns the error the connection was closed with or nil if
+// the connection is still open.
+func (c *Conn) Err() error {
+	if c.isClosed() {
+		return c.closeErr
+	}
+	return nil
+}
+
+// Underlying returns the net.Conn the connection runs over so that socket
+// options such as TCP keepalives can be set. It returns nil if the connection
+// does not run over a net.Conn, such as when dialed with an http.Client whose
+// transport does not return one.
+//
+// Only use it for metadata and socket options. Reading from, writing to or
+// setting deadlines on it will corrupt the WebSocket framing.
+func (c *Conn) Underlying() net.Conn {
+	nc, _ := c.rwc.(net.Conn)
+	return nc
+}
+
 func (c *Conn) close(err error) {
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
@@ -148,6 +395,7 @@ func (c *Conn) close(err error) {
 func (c *Conn) timeoutLoop() {
 	readCtx := context.Background()
 	writeCtx := context.Background()
+	writerCtx := context.Background()
 
 	for {
 		select {
@@ -156,17 +404,134 @@ func (c *Conn) timeoutLoop() {
 
 		case writeCtx = <-c.writeTimeout:
 		case readCtx = <-c.readTimeout:
+		case writerCtx = <-c.writerTimeout:
 
+		// As the channels are buffered, a newer context may be waiting
+		// which means the read or write bounded by the expired context
+		// has already completed.
 		case <-readCtx.Done():
+			if len(c.readTimeout) > 0 {
+				readCtx = <-c.readTimeout
+				continue
+			}
 			c.setCloseErr(fmt.Errorf("read timed out: %w", readCtx.Err()))
 			go c.writeError(StatusPolicyViolation, errors.New("timed out"))
 		case <-writeCtx.Done():
+			if len(c.writeTimeout) > 0 {
+				writeCtx = <-c.writeTimeout
+				continue
+			}
 			c.close(fmt.Errorf("write timed out: %w", writeCtx.Err()))
 			return
+		case <-writerCtx.Done():
+			if len(c.writerTimeout) > 0 {
+				writerCtx = <-c.writerTimeout
+				continue
+			}
+			if len(c.writeTimeout) > 0 {
+				writeCtx = <-c.writeTimeout
+				continue
+			}
+			if writeCtx.Err() != nil {
+				// A write of the writer is in progress and times out
+				// with the same context.
+				c.close(fmt.Errorf("write timed out: %w", writeCtx.Err()))
+				return
+			}
+			// Otherwise the abandoned writer would hold the lock
+			// forever and block every later write.
+			c.close(errors.New("writer abandoned: its context was done before it was closed"))
+			return
 		}
 	}
 }
 
+// SetDefaultReadTimeout sets the timeout applied to Reader and Read
+// when the passed context has no deadline.
+//
+// The timeout bounds both waiting for the message and reading it.
+// A context with a deadline always takes precedence.
+//
+// By default, there is no timeout.
+func (c *Conn) SetDefaultReadTimeout(d time.Duration) {
+	c.defaultReadTimeout.Store(int64(d))
+}
+
+// SetDefaultWriteTimeout sets the timeout applied to Writer and Write
+// when the passed context has no deadline.
+//
+// A context with a deadline always takes precedence.
+//
+// By default, there is no timeout.
+func (c *Conn) SetDefaultWriteTimeout(d time.Duration) {
+	c.defaultWriteTimeout.Store(int64(d))
+}
+
+// SetControlWriteTimeout sets the timeout for writing a ping, pong or close
+// frame, including the close frame written by Close. It is applied in
+// addition to any context passed in.
+//
+// Lower it to fail faster on a wedged connection or raise it for slow
+// networks. If d <= 0, the default of 5s is used.
+func (c *Conn) SetControlWriteTimeout(d time.Duration) {
+	if d <= 0 {
+		d = time.Second * 5
+	}
+	c.controlWriteTimeout.Store(int64(d))
+}
+
+// SetReadDeadline sets the deadline applied to Reader and Read
+// calls made afterwards when the passed context has no deadline.
+// A zero value for t means no deadline.
+//
+// Unlike with net.Conn, hitting the deadline closes the connection
+// as with any other context expiring. If a default read timeout is
+// also set, the earlier of the two applies.
+func (c *Conn) SetReadDeadline(t time.Time) {
+	storeDeadline(&c.readDeadline, t)
+}
+
+// SetWriteDeadline sets the deadline applied to Writer and Write
+// calls made afterwards when the passed context has no deadline.
+// A zero value for t means no deadline.
+//
+// Unlike with net.Conn, hitting the deadline closes the connection
+// as with any other context expiring. If a default write timeout is
+// also set, the earlier of the two applies.
+func (c *Conn) SetWriteDeadline(t time.Time) {
+	storeDeadline(&c.writeDeadline, t)
+}
+
+func storeDeadline(d *xsync.Int64, t time.Time) {
+	if t.IsZero() {
+		d.Store(0)
+		return
+	}
+	d.Store(t.UnixNano())
+}
+
+// withDefaultTimeout bounds ctx by the default timeout d and the deadline
+// if ctx does not have a deadline of its own.
+func withDefaultTimeout(ctx context.Context, d, deadline *xsync.Int64) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+
+	var t time.Time
+	if timeout := time.Duration(d.Load()); timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if dl := deadline.Load(); dl != 0 {
+		if dt := time.Unix(0, dl); t.IsZero() || dt.Before(t) {
+			t = dt
+		}
+	}
+	if t.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, t)
+}
+
 func (c *Conn) flate() bool {
 	return c.copts != nil
 }
@@ -177,21 +542,152 @@ func (c *Conn) flate() bool {
 // not read from the connection but instead waits for a Reader call
 // to read the pong.
 //
+// If the context expires before the pong is received, the connection
+// is closed like with any other error. There is thus no such thing as
+// a late pong and the timeout should account for the peer's worst case latency.
+//
 // TCP Keepalives should suffice for most use cases.
 func (c *Conn) Ping(ctx context.Context) error {
 	p := atomic.AddInt32(&c.pingCounter, 1)
 
-	err := c.ping(ctx, strconv.Itoa(int(p)))
+	_, err := c.ping(ctx, strconv.Itoa(int(p)))
+	if err != nil {
+		return fmt.Errorf("failed to ping: %w", err)
+	}
+	return nil
+}
+
+// PingTimed is like Ping but also returns the round trip time.
+//
+// The measurement starts once the ping has been written so it excludes
+// the time spent waiting for other writes to complete. It includes the time
+// until a concurrent Reader call reads the pong.
+func (c *Conn) PingTimed(ctx context.Context) (time.Duration, error) {
+	p := atomic.AddInt32(&c.pingCounter, 1)
+
+	rtt, err := c.ping(ctx, strconv.Itoa(int(p)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to ping: %w", err)
+	}
+	return rtt, nil
+}
+
+// PingPayload is like Ping but sends p as the payload of the ping and waits
+// for a pong with the same payload. Use it to embed application data such as
+// a trace id or timestamp in the ping.
+//
+// p must be at most 125 bytes and must not be the payload of another ping
+// still waiting for its pong. Ping uses decimal integers as payloads.
+func (c *Conn) PingPayload(ctx context.Context, p []byte) error {
+	if len(p) > maxControlPayload {
+		return fmt.Errorf("failed to ping: payload of %v bytes exceeds the maximum of %v bytes", len(p), maxControlPayload)
+	}
+
+	_, err := c.ping(ctx, string(p))
 	if err != nil {
 		return fmt.Errorf("failed to ping: %w", err)
 	}
 	return nil
 }
 
-func (c *Conn) ping(ctx context.Context, p string) error {
-	pong := make(chan struct{})
+// SetCoalescedPongs sets whether a pong also answers every Ping sent
+// before the one it answers.
+//
+// RFC 6455 allows a peer to only respond to the most recent ping when several
+// are outstanding. Enable this for such peers to avoid earlier Ping calls
+// timing out even though the connection is healthy.
+//
+// By default, every Ping waits for a pong with its exact payload.
+// It must be called before the connection is used.
+func (c *Conn) SetCoalescedPongs(enabled bool) {
+	c.coalescedPongs = enabled
+}
+
+// SetPongHandler sets a function that is called with the payload of every
+// pong received, including unsolicited ones which RFC 6455 allows to be used
+// as a unidirectional heartbeat. Pongs answering a Ping still signal it.
+//
+// It is called from the goroutine reading the connection so it must not
+// block or read from the connection. The payload must not be retained.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetPongHandler(fn func(payload []byte)) {
+	c.pongHandler = fn
+}
 
+// SetPingInterval enables keepalive pings. Every interval, a ping is sent
+// and the connection is closed if its pong is not received before the next
+// ping is due. This keeps idle connections alive through load balancers and
+// detects dead peers.
+//
+// As with Ping, the connection must be read concurrently for pongs to be
+// received. See CloseRead if you do not otherwise read from the connection.
+//
+// By default, or if interval is zero, no keepalive pings are sent.
+// It must be called at most once and before the connection is used.
+func (c *Conn) SetPingInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go c.pingLoop(interval)
+}
+
+func (c *Conn) pingLoop(interval time.Duration) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.touch:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(interval)
+			continue
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.Ping(ctx)
+		cancel()
+		if err != nil {
+			c.close(fmt.Errorf("keepalive failed: %w", err))
+			return
+		}
+		t.Reset(interval)
+	}
+}
+
+// Touch defers the next keepalive ping sent because of SetPingInterval by
+// a full interval as if traffic had just occurred. Use it when the peer is
+// known to be alive through another signal, such as activity on a sibling
+// connection, to avoid sending pings that are not needed.
+//
+// It does nothing if no ping interval is set.
+func (c *Conn) Touch() {
+	select {
+	case c.touch <- struct{}{}:
+	default:
+	}
+}
+
+// pongPool reuses the channels used to signal pongs to Ping.
+// Each has a buffer of 1 so that handleControl can signal without blocking.
+var pongPool = sync.Pool{
+	New: func() interface{} {
+		return make(chan struct{}, 1)
+	},
+}
+
+func (c *Conn) ping(ctx context.Context, p string) (time.Duration, error) {
 	c.activePingsMu.Lock()
+	if _, ok := c.activePings[p]; ok {
+		c.activePingsMu.Unlock()
+		return 0, fmt.Errorf("ping with payload %q is already waiting for its pong", p)
+	}
+	pong := pongPool.Get().(chan struct{})
 	c.activePings[p] = pong
 	c.activePingsMu.Unlock()
 
@@ -199,22 +695,33 @@ func (c *Conn) ping(ctx context.Context, p string) error {
 		c.activePingsMu.Lock()
 		delete(c.activePings, p)
 		c.activePingsMu.Unlock()
+
+		// As handleControl only signals with activePingsMu held, nothing can
+		// signal pong anymore. Drain it in case the pong arrived after we
+		// stopped waiting so that it is empty for the next Ping.
+		select {
+		case <-pong:
+		default:
+		}
+		pongPool.Put(pong)
 	}()
 
 	err := c.writeControl(ctx, opPing, []byte(p))
 	if err != nil {
-		return err
+		return 0, err
 	}
+	atomic.AddInt64(&c.stats.PingsSent, 1)
+	start := time.Now()
 
 	select {
 	case <-c.closed:
-		return c.closeErr
+		return 0, c.closeErr
 	case <-ctx.Done():
 		err := fmt.Errorf("failed to wait for pong: %w", ctx.Err())
 		c.close(err)
-		return err
+		return 0, err
 	case <-pong:
-		return nil
+		return time.Since(start), nil
 	}
 }
 
@@ -257,6 +764,26 @@ func (m *mu) lock(ctx context.Context) error {
 	}
 }
 
+// tryLock is like lock but instead of waiting when the lock is held,
+// it returns false.
+func (m *mu) tryLock() (bool, error) {
+	select {
+	case <-m.c.closed:
+		return false, m.c.closeErr
+	case m.ch <- struct{}{}:
+		// See lock.
+		select {
+		case <-m.c.closed:
+			m.unlock()
+			return false, m.c.closeErr
+		default:
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func (m *mu) unlock() {
 	select {
 	case <-m.ch:
@@ -4,15 +4,25 @@ package websocket_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -72,6 +82,13 @@ func TestConn(t *testing.T) {
 
 		err := c1.Close(-1, "")
 		assert.Contains(t, err, "failed to marshal close frame: status code StatusCode(-1) cannot be set")
+
+		var che websocket.CloseHandshakeError
+		if !errors.As(err, &che) {
+			t.Fatalf("expected CloseHandshakeError: %+v", err)
+		}
+		assert.Equal(t, "sent close", false, che.SentClose)
+		assert.Equal(t, "sent code", websocket.StatusCode(-1), che.SentCode)
 	})
 
 	t.Run("ping", func(t *testing.T) {
@@ -90,6 +107,45 @@ func TestConn(t *testing.T) {
 		assert.Success(t, err)
 	})
 
+	t.Run("pingTimed", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		rtt, err := c1.PingTimed(tt.ctx)
+		assert.Success(t, err)
+		if rtt <= 0 {
+			t.Fatalf("expected positive round trip time: %v", rtt)
+		}
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("pingPayload", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		pongs := make(chan string, 1)
+		c1.SetPongHandler(func(p []byte) {
+			pongs <- string(p)
+		})
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		err := c1.PingPayload(tt.ctx, []byte("trace-42"))
+		assert.Success(t, err)
+		assert.Equal(t, "pong payload", "trace-42", <-pongs)
+
+		err = c1.PingPayload(tt.ctx, xrand.Bytes(126))
+		assert.Contains(t, err, "exceeds the maximum of 125 bytes")
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
 	t.Run("badPing", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -103,6 +159,291 @@ func TestConn(t *testing.T) {
 		assert.Contains(t, err, "failed to wait for pong")
 	})
 
+	t.Run("controlFrameLimit", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.SetControlFrameLimit(2)
+		c2.CloseRead(tt.ctx)
+
+		for i := 0; i < 2; i++ {
+			err := c1.Ping(tt.ctx)
+			assert.Success(t, err)
+		}
+		assert.Equal(t, "control frame rate", 2, c2.ControlFrameRate())
+
+		err := c1.Ping(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+	})
+
+	t.Run("controlFrameRateWindow", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		err := c1.Ping(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "control frame rate", 1, c2.ControlFrameRate())
+
+		// The window has passed without another control frame.
+		time.Sleep(time.Second)
+		assert.Equal(t, "control frame rate", 0, c2.ControlFrameRate())
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("oversizedControlFrame", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		rejected := make(chan error, 1)
+		c2.SetRejectedControlFrameHandler(func(err error) {
+			rejected <- err
+		})
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusProtocolError, err)
+		})
+
+		errs := xsync.Go(func() error {
+			_, err := c1.WriteFrame(tt.ctx, true, websocket.OpPing, xrand.Bytes(200))
+			return err
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "received control frame payload with invalid length: 200")
+		assert.Contains(t, <-rejected, "invalid length: 200")
+
+		for _, errs := range []<-chan error{errs, readErr} {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+	})
+
+	t.Run("closeReasonFunc", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.SetReadLimit(10)
+		c2.SetCloseReasonFunc(func(code websocket.StatusCode, err error) string {
+			return fmt.Sprintf("ref 42: %v", code)
+		})
+
+		readErr := xsync.Go(func() error {
+			err := c1.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(100))
+			if err != nil {
+				return err
+			}
+			_, _, err = c1.Read(tt.ctx)
+			var ce websocket.CloseError
+			if !errors.As(err, &ce) {
+				return fmt.Errorf("expected CloseError: %w", err)
+			}
+			if ce.Reason != "ref 42: StatusMessageTooBig" {
+				return fmt.Errorf("unexpected close reason: %q", ce.Reason)
+			}
+			return nil
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "read limited at 10 bytes")
+
+		select {
+		case err := <-readErr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("reservedOpcode", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		var logs bytes.Buffer
+		c2.SetErrorLog(log.New(&logs, "", 0))
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			if errors.Is(err, websocket.ErrProtocolViolation) {
+				return fmt.Errorf("unexpected protocol violation: %w", err)
+			}
+			return assertCloseStatus(websocket.StatusProtocolError, err)
+		})
+
+		errs := xsync.Go(func() error {
+			_, err := c1.WriteFrame(tt.ctx, true, websocket.OpCode(3), []byte("hi"))
+			return err
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "received unknown opcode")
+		assert.Contains(t, logs.String(), "peer sent frame with reserved opcode 3")
+		assert.Equal(t, "protocol violation", true, errors.Is(err, websocket.ErrProtocolViolation))
+
+		err = c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Equal(t, "protocol violation", true, errors.Is(err, websocket.ErrProtocolViolation))
+
+		for _, errs := range []<-chan error{errs, readErr} {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+	})
+
+	t.Run("closeMarshalErrorLog", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		var logs bytes.Buffer
+		c1.SetErrorLog(log.New(&logs, "", 0))
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, strings.Repeat("x", 124))
+		assert.Contains(t, err, "failed to marshal close frame")
+		assert.Contains(t, logs.String(), "websocket: failed to marshal close frame")
+	})
+
+	t.Run("defaultReadTimeout", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetDefaultReadTimeout(time.Millisecond * 100)
+
+		errs := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		})
+
+		_, b, err := c1.Read(context.Background())
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("hi"), b)
+		assert.Success(t, <-errs)
+
+		_, _, err = c1.Read(context.Background())
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
+	t.Run("defaultReadTimeoutReadAfterEOF", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetDefaultReadTimeout(time.Minute)
+
+		errs := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		})
+
+		_, r, err := c1.Reader(context.Background())
+		assert.Success(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("hi"), b)
+		assert.Success(t, <-errs)
+
+		// The message's context is done once read so reading
+		// again must not close the connection.
+		for i := 0; i < 10; i++ {
+			_, err = r.Read(make([]byte, 1))
+			assert.Equal(t, "read err", io.EOF, err)
+		}
+		assert.Success(t, c1.Err())
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("defaultWriteTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetDefaultWriteTimeout(time.Millisecond * 100)
+
+		err := c1.Write(context.Background(), websocket.MessageBinary, xrand.Bytes(8192))
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
+	t.Run("controlWriteTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetControlWriteTimeout(time.Millisecond * 100)
+
+		// The peer never reads so writing the close frame blocks.
+		start := time.Now()
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Error(t, err)
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("close took %v", d)
+		}
+	})
+
+	t.Run("writerCloseTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		})
+		defer tt.cleanup()
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+
+		w, err := c1.Writer(ctx, websocket.MessageBinary)
+		assert.Success(t, err)
+
+		// Fits in the write buffer so only the final flush blocks.
+		_, err = w.Write([]byte("hi"))
+		assert.Success(t, err)
+
+		err = w.Close()
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
+	t.Run("readDeadline", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadDeadline(time.Now().Add(time.Hour))
+		c1.SetReadDeadline(time.Time{})
+
+		errs := xsync.Go(func() error {
+			time.Sleep(time.Millisecond * 100)
+			return c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		})
+
+		_, b, err := c1.Read(context.Background())
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("hi"), b)
+		assert.Success(t, <-errs)
+
+		c1.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		_, _, err = c1.Read(context.Background())
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
+	t.Run("writeDeadline", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+
+		err := c1.Write(context.Background(), websocket.MessageBinary, xrand.Bytes(8192))
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
 	t.Run("concurrentWrite", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -130,120 +471,2101 @@ func TestConn(t *testing.T) {
 			case <-tt.ctx.Done():
 				t.Fatal(tt.ctx.Err())
 			}
-		}
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("concurrentWriteError", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		_, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
+		assert.Equal(t, "write error", context.DeadlineExceeded, err)
+	})
+
+	t.Run("writeAndClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		errs := xsync.Go(func() error {
+			return c1.WriteAndClose(tt.ctx, websocket.MessageText, []byte("bye"), websocket.StatusGoingAway, "done")
+		})
+
+		typ, b, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read type", websocket.MessageText, typ)
+		assert.Equal(t, "read msg", []byte("bye"), b)
+
+		_, _, err = c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("writeAndCloseTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		// The peer never reads so the context must bound the whole close.
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+		start := time.Now()
+		err := c1.WriteAndClose(ctx, websocket.MessageText, []byte("bye"), websocket.StatusGoingAway, "done")
+		assert.Error(t, err)
+		if time.Since(start) > time.Second {
+			t.Fatalf("WriteAndClose ignored its context: took %v", time.Since(start))
+		}
+	})
+
+	t.Run("messageFilter", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 1,
+		}, &websocket.AcceptOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 1,
+		})
+		defer tt.cleanup()
+
+		c2.SetMessageFilter(func(h websocket.MessageHeader) error {
+			if h.Compressed {
+				return errors.New("unexpected compressed message")
+			}
+			return nil
+		})
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusPolicyViolation, err)
+		})
+
+		go c1.Write(tt.ctx, websocket.MessageText, []byte(strings.Repeat("x", 128)))
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "message rejected: unexpected compressed message")
+
+		select {
+		case err := <-readErr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("readBuffered", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		msgs := [][]byte{xrand.Bytes(100), {}, xrand.Bytes(1000)}
+		errs := xsync.Go(func() error {
+			for _, msg := range msgs {
+				err := c2.Write(tt.ctx, websocket.MessageBinary, msg)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, msg := range msgs {
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+		}
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("readLimitDisabled", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadLimit(-1)
+
+		msg := xrand.Bytes(1 << 16)
+		errs := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("readFull", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		errs := xsync.Go(func() error {
+			err := c2.WriteFragmented(tt.ctx, websocket.MessageText, [][]byte{
+				[]byte("hello"), []byte(" "), []byte("world"),
+			})
+			if err != nil {
+				return err
+			}
+			err = c2.WriteFragmented(tt.ctx, websocket.MessageText, [][]byte{
+				[]byte("hello"), []byte(" "), []byte("world!"),
+			})
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusMessageTooBig, err)
+		})
+
+		_, _, err := c1.ReadFull(tt.ctx, -1)
+		assert.Contains(t, err, "max size must not be negative")
+
+		typ, b, err := c1.ReadFull(tt.ctx, 11)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		assert.Equal(t, "msg", "hello world", string(b))
+
+		_, _, err = c1.ReadFull(tt.ctx, 11)
+		var rle websocket.ReadLimitError
+		if !errors.As(err, &rle) {
+			t.Fatalf("expected ReadLimitError: %v", err)
+		}
+		assert.Equal(t, "limit", int64(11), rle.Limit)
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("readInto", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		errs := xsync.Go(func() error {
+			for _, msg := range []string{"hi", "hello", "hey"} {
+				err := c2.Write(tt.ctx, websocket.MessageText, []byte(msg))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		buf := make([]byte, 4)
+		typ, n, err := c1.ReadInto(tt.ctx, buf)
+		assert.Success(t, err)
+		assert.Equal(t, "msg type", websocket.MessageText, typ)
+		assert.Equal(t, "msg", "hi", string(buf[:n]))
+
+		_, n, err = c1.ReadInto(tt.ctx, buf)
+		assert.Equal(t, "short buffer", true, errors.Is(err, io.ErrShortBuffer))
+		assert.Equal(t, "msg", "hell", string(buf[:n]))
+
+		_, n, err = c1.ReadInto(tt.ctx, buf)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "hey", string(buf[:n]))
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("readerRemaining", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		// The message's context is done once read to EOF.
+		c1.SetDefaultReadTimeout(time.Minute)
+
+		errs := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(100))
+		})
+
+		_, r, err := c1.Reader(context.Background())
+		assert.Success(t, err)
+		rr, ok := r.(interface{ Remaining() int64 })
+		if !ok {
+			t.Fatalf("reader does not implement Remaining: %T", r)
+		}
+		assert.Equal(t, "remaining", int64(100), rr.Remaining())
+
+		_, err = io.ReadFull(r, make([]byte, 60))
+		assert.Success(t, err)
+		assert.Equal(t, "remaining", int64(40), rr.Remaining())
+
+		_, err = ioutil.ReadAll(r)
+		assert.Success(t, err)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "remaining", int64(0), rr.Remaining())
+		}
+		assert.Success(t, c1.Err())
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("readerFrameRemaining", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		// The message's context is done once read to EOF.
+		c1.SetReadDeadline(time.Now().Add(time.Minute))
+
+		errs := xsync.Go(func() error {
+			return c2.WriteFragmented(tt.ctx, websocket.MessageBinary, [][]byte{
+				[]byte("abc"), []byte("defgh"),
+			})
+		})
+
+		_, r, err := c1.Reader(context.Background())
+		assert.Success(t, err)
+		fr, ok := r.(interface{ FrameRemaining() (int64, bool) })
+		if !ok {
+			t.Fatalf("reader does not implement FrameRemaining: %T", r)
+		}
+
+		assertFrameRemaining := func(expN int64, expFin bool) {
+			t.Helper()
+			n, fin := fr.FrameRemaining()
+			assert.Equal(t, "frame remaining", expN, n)
+			assert.Equal(t, "fin", expFin, fin)
+		}
+
+		assertFrameRemaining(3, false)
+		_, err = io.ReadFull(r, make([]byte, 3))
+		assert.Success(t, err)
+		assertFrameRemaining(0, false)
+		_, err = io.ReadFull(r, make([]byte, 1))
+		assert.Success(t, err)
+		assertFrameRemaining(4, true)
+
+		_, err = ioutil.ReadAll(r)
+		assert.Success(t, err)
+		for i := 0; i < 10; i++ {
+			assertFrameRemaining(0, true)
+		}
+		assert.Success(t, c1.Err())
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeHighWater", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetWriteBufferHighWater(1 << 14)
+
+		msg := xrand.Bytes(1 << 14)
+		errs := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+
+		// The first write cannot complete until c2 reads the rest of it.
+		_, r, err := c2.Reader(tt.ctx)
+		assert.Success(t, err)
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("x"))
+		if !errors.Is(err, websocket.ErrBackpressure) {
+			t.Fatalf("expected ErrBackpressure: %v", err)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+		assert.Success(t, <-errs)
+
+		tt.goDiscardLoop(c2)
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("x"))
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeHighWaterBlocking", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetWriteBufferHighWater(1 << 14)
+		c1.SetWriteBufferBlocking(true)
+
+		msg := xrand.Bytes(1 << 14)
+		errs := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+
+		// The first write cannot complete until c2 reads the rest of it.
+		_, r, err := c2.Reader(tt.ctx)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*50)
+		defer cancel()
+		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
+		assert.Contains(t, err, "deadline exceeded")
+
+		blockedErrs := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageText, []byte("x"))
+		})
+
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+		assert.Success(t, <-errs)
+
+		_, b, err = c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("x"), b)
+		assert.Success(t, <-blockedErrs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("memoryLimiter", func(t *testing.T) {
+		ml := websocket.NewMemoryLimiter(64)
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			MemoryLimiter: ml,
+		}, &websocket.AcceptOptions{
+			MemoryLimiter: ml,
+		})
+		defer tt.cleanup()
+
+		errs := xsync.Go(func() error {
+			err := c2.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(64))
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(65))
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusTryAgainLater, err)
+		})
+
+		_, _, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "memory used", int64(0), ml.Used())
+
+		_, _, err = c1.Read(tt.ctx)
+		assert.Contains(t, err, "memory limit of 64 bytes exhausted")
+		assert.Equal(t, "memory used", int64(0), ml.Used())
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("memoryLimiterConcurrent", func(t *testing.T) {
+		ml := websocket.NewMemoryLimiter(4096)
+		dopts := &websocket.DialOptions{MemoryLimiter: ml}
+		aopts := &websocket.AcceptOptions{MemoryLimiter: ml}
+		tt, a1, a2 := newConnTest(t, dopts, aopts)
+		defer tt.cleanup()
+		b1, b2 := wstest.Pipe(dopts, aopts)
+		defer b1.Close(websocket.StatusInternalError, "")
+		defer b2.Close(websocket.StatusInternalError, "")
+
+		// The read of the first message blocks with its buffer reserved
+		// until its final frame is written.
+		a2.CloseRead(tt.ctx)
+		first := xrand.Bytes(3000)
+		errs := xsync.Go(func() error {
+			_, err := a2.WriteFrame(tt.ctx, false, websocket.OpBinary, first)
+			if err != nil {
+				return err
+			}
+			// Flushes the frame.
+			_, err = a2.WriteFrame(tt.ctx, true, websocket.OpPong, nil)
+			return err
+		})
+		readErr := make(chan error, 1)
+		go func() {
+			_, p, err := a1.Read(tt.ctx)
+			if err == nil && !bytes.Equal(p, append(first, "end"...)) {
+				err = errors.New("unexpected message")
+			}
+			readErr <- err
+		}()
+		assert.Success(t, <-errs)
+		for ml.Used() < int64(len(first)) {
+			select {
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			case <-time.After(time.Millisecond):
+			}
+		}
+		used := ml.Used()
+
+		large := xrand.Bytes(1 << 20)
+		b1.SetReadLimit(2 << 20)
+		b2.CloseRead(tt.ctx)
+		// The write fails once b1 closes but only returns when its context is done.
+		writeCtx, cancelWrite := context.WithCancel(tt.ctx)
+		defer cancelWrite()
+		go b2.WriteFrame(writeCtx, true, websocket.OpBinary, large)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := b1.ReadRaw(tt.ctx)
+		runtime.ReadMemStats(&after)
+		assert.Contains(t, err, "memory limit of 4096 bytes exhausted")
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= uint64(len(large)) {
+			t.Fatalf("rejected read allocated %v bytes", allocated)
+		}
+		assert.Equal(t, "memory used", used, ml.Used())
+		cancelWrite()
+
+		_, err = a2.WriteFrame(tt.ctx, true, websocket.OpContinuation, []byte("end"))
+		assert.Success(t, err)
+		assert.Success(t, <-readErr)
+		assert.Equal(t, "memory used", int64(0), ml.Used())
+
+		err = a1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadLimit(1 << 20)
+		c2.SetReadLimit(1 << 20)
+		echoErr := xsync.Go(func() error {
+			return websocket.Echo(tt.ctx, c2)
+		})
+
+		msgs := []struct {
+			typ websocket.MessageType
+			p   []byte
+		}{
+			{websocket.MessageText, []byte("hello")},
+			{websocket.MessageBinary, xrand.Bytes(64 << 10)},
+			{websocket.MessageBinary, nil},
+		}
+		for _, msg := range msgs {
+			writeErr := xsync.Go(func() error {
+				return c1.Write(tt.ctx, msg.typ, msg.p)
+			})
+			typ, p, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Success(t, <-writeErr)
+			assert.Equal(t, "type", msg.typ, typ)
+			assert.Equal(t, "payload", true, bytes.Equal(msg.p, p))
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(<-echoErr))
+	})
+
+	t.Run("readGzip", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		gzipBytes := func(p []byte) []byte {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			gw.Write(p)
+			gw.Close()
+			return buf.Bytes()
+		}
+
+		msg := xrand.Bytes(512)
+		errs := xsync.Go(func() error {
+			err := c2.Write(tt.ctx, websocket.MessageBinary, gzipBytes(msg))
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageBinary, gzipBytes(make([]byte, 4096)))
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusMessageTooBig, err)
+		})
+
+		c1.SetReadLimit(1024)
+
+		typ, r, err := c1.ReadGzip(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read type", websocket.MessageBinary, typ)
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+		assert.Success(t, r.Close())
+
+		_, r, err = c1.ReadGzip(tt.ctx)
+		assert.Success(t, err)
+		_, err = ioutil.ReadAll(r)
+		var rle websocket.ReadLimitError
+		if !errors.As(err, &rle) {
+			t.Fatalf("expected ReadLimitError: %v", err)
+		}
+		assert.Equal(t, "read limit", int64(1024), rle.Limit)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("compressedReadLimit", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		c1.SetReadLimit(1024)
+
+		// Compresses to a few KB but inflates to 1 MB.
+		go c2.Write(tt.ctx, websocket.MessageBinary, make([]byte, 1<<20))
+		errs := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusMessageTooBig, err)
+		})
+
+		_, _, err := c1.Read(tt.ctx)
+		var rle websocket.ReadLimitError
+		if !errors.As(err, &rle) {
+			t.Fatalf("expected ReadLimitError: %v", err)
+		}
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("lastFrameInfo", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		errs := xsync.Go(func() error {
+			return c2.WriteFragmented(tt.ctx, websocket.MessageText, [][]byte{
+				[]byte("frag"), []byte("men"), []byte("ted"),
+			})
+		})
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("fragmented"), b)
+		assert.Success(t, <-errs)
+		assert.Equal(t, "frame info", websocket.FrameInfo{
+			Frames: 3,
+			Length: 10,
+		}, c1.LastFrameInfo())
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("incompressible", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		random := xrand.Bytes(4096)
+		compressible := bytes.Repeat([]byte("compressible"), 512)
+
+		errs := xsync.Go(func() error {
+			err := c2.Write(tt.ctx, websocket.MessageBinary, random)
+			if err != nil {
+				return err
+			}
+			return c2.Write(tt.ctx, websocket.MessageBinary, compressible)
+		})
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", random, b)
+		assert.Equal(t, "frame info", websocket.FrameInfo{
+			Frames: 1,
+			Length: int64(len(random)),
+		}, c1.LastFrameInfo())
+
+		_, b, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", compressible, b)
+		assert.Equal(t, "compressed", true, c1.LastFrameInfo().Compressed)
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("tryWriter", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goDiscardLoop(c2)
+
+		w, ok, err := c1.TryWriter(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		assert.Equal(t, "acquired", true, ok)
+
+		_, ok, err = c1.TryWriter(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		assert.Equal(t, "acquired while held", false, ok)
+
+		_, err = w.Write([]byte("hello"))
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+
+		w, ok, err = c1.TryWriter(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		assert.Equal(t, "acquired after close", true, ok)
+		err = w.Close()
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("abandonedWriter", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		ctx, cancel := context.WithCancel(tt.ctx)
+		w, err := c1.Writer(ctx, websocket.MessageText)
+		assert.Success(t, err)
+		_, err = w.Write([]byte("hi"))
+		assert.Success(t, err)
+		// Abandons the writer without closing it.
+		cancel()
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Contains(t, err, "writer abandoned")
+	})
+
+	t.Run("closedWriterCancelled", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goDiscardLoop(c2)
+
+		for i := 0; i < 10; i++ {
+			ctx, cancel := context.WithCancel(tt.ctx)
+			w, err := c1.Writer(ctx, websocket.MessageText)
+			assert.Success(t, err)
+			_, err = w.Write([]byte("hi"))
+			assert.Success(t, err)
+			err = w.Close()
+			assert.Success(t, err)
+			cancel()
+		}
+
+		err := c1.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("framesWritten", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		tt.goDiscardLoop(c2)
+
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		fw, ok := w.(interface{ FramesWritten() int })
+		if !ok {
+			t.Fatalf("writer does not implement FramesWritten: %T", w)
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err = w.Write([]byte("hello"))
+			assert.Success(t, err)
+		}
+		assert.Equal(t, "frames written", 2, fw.FramesWritten())
+
+		err = w.Close()
+		assert.Success(t, err)
+		assert.Equal(t, "frames written", 3, fw.FramesWritten())
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("frameHooks", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		var mu sync.Mutex
+		var read, written []websocket.FrameTrace
+		c1.SetFrameHooks(func(ft websocket.FrameTrace) {
+			mu.Lock()
+			read = append(read, ft)
+			mu.Unlock()
+		}, func(ft websocket.FrameTrace) {
+			mu.Lock()
+			written = append(written, ft)
+			mu.Unlock()
+		})
+
+		errs := xsync.Go(func() error {
+			typ, b, err := c2.Read(tt.ctx)
+			if err != nil {
+				return err
+			}
+			return c2.Write(tt.ctx, typ, b)
+		})
+
+		err := c1.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+		assert.Success(t, err)
+		_, _, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+
+		client := c1.Info().Client
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "frames written", []websocket.FrameTrace{
+			{Opcode: 1, Fin: true, Masked: client, Length: 5},
+			{Opcode: 8, Fin: true, Masked: client, Length: 2},
+		}, written)
+		assert.Equal(t, "frames read", []websocket.FrameTrace{
+			{Opcode: 1, Fin: true, Masked: !client, Length: 5},
+			{Opcode: 8, Fin: true, Masked: !client, Length: 2},
+		}, read)
+	})
+
+	t.Run("roles", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			Role: websocket.RoleWriteOnly,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		_, _, err := c2.Read(ctx)
+		assert.Contains(t, err, "connection is write only")
+
+		c1.CloseRead(ctx)
+		err = c1.Ping(ctx)
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+
+		c1, c2 = wstest.Pipe(nil, &websocket.AcceptOptions{
+			Role: websocket.RoleWriteOnly,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		err = c1.Write(ctx, websocket.MessageText, []byte("hi"))
+		assert.Success(t, err)
+		_, _, err = c1.Read(ctx)
+		assert.Equal(t, "close status", websocket.StatusProtocolError, websocket.CloseStatus(err))
+
+		c1, c2 = wstest.Pipe(nil, &websocket.AcceptOptions{
+			Role: websocket.RoleReadOnly,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		err = c2.Write(ctx, websocket.MessageText, []byte("hi"))
+		assert.Contains(t, err, "connection is read only")
+
+		c1.CloseRead(ctx)
+		err = c2.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("info", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			Subprotocols:    []string{"chat", "echo"},
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			Subprotocols:    []string{"echo"},
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		ci := c1.Info()
+		assert.Equal(t, "subprotocol", "echo", ci.Subprotocol)
+		assert.Equal(t, "extensions", "permessage-deflate", ci.Extensions)
+		assert.Equal(t, "compression mode", websocket.CompressionContextTakeover, ci.CompressionMode)
+		assert.Equal(t, "compression threshold", 128, ci.CompressionThreshold)
+		assert.Equal(t, "client", true, ci.Client)
+		assert.Equal(t, "url", "ws://example.com", ci.URL.String())
+		assert.Equal(t, "offered subprotocols", []string(nil), c1.OfferedSubprotocols())
+
+		ci = c2.Info()
+		assert.Equal(t, "subprotocol", "echo", ci.Subprotocol)
+		assert.Equal(t, "client", false, ci.Client)
+		assert.Equal(t, "url host", "example.com", ci.URL.Host)
+		assert.Equal(t, "remote addr", "pipe", ci.RemoteAddr.String())
+		assert.Equal(t, "underlying remote addr", ci.RemoteAddr, c2.Underlying().RemoteAddr())
+		assert.Equal(t, "offered subprotocols", []string{"chat", "echo"}, c2.OfferedSubprotocols())
+
+		c2.CloseRead(context.Background())
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("partialFrameTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := wstest.Pipe(nil, nil)
+		defer c1.Underlying().Close()
+		defer c2.Underlying().Close()
+
+		// A binary frame header announcing 10 bytes followed by only 2 of them.
+		go c2.Underlying().Write([]byte{0x82, 10, 'h', 'i'})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		// The read is blocked on the rest of the payload and must be
+		// unblocked as soon as ctx expires.
+		start := time.Now()
+		_, _, err := c1.Read(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded: %+v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("read took %v to be interrupted", d)
+		}
+	})
+
+	t.Run("sizeHistograms", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		read := websocket.NewSizeHistogram(1024, 16)
+		written := websocket.NewSizeHistogram(16, 1024)
+		c1.SetSizeHistograms(read, written)
+
+		for _, n := range []int{10, 100, 2000} {
+			msg := xrand.Bytes(n)
+			err := c1.Write(tt.ctx, websocket.MessageBinary, msg)
+			assert.Success(t, err)
+
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+		}
+
+		assert.Equal(t, "bounds", []int64{16, 1024}, read.Bounds())
+		assert.Equal(t, "read counts", []int64{1, 1, 1}, read.Counts())
+		assert.Equal(t, "written counts", []int64{1, 1, 1}, written.Counts())
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("done", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		assert.Success(t, c1.Err())
+		assert.Equal(t, "closed", false, c1.IsClosed())
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+		err := c2.Close(websocket.StatusGoingAway, "")
+		assert.Success(t, err)
+
+		select {
+		case <-c1.Done():
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+		assert.Equal(t, "closed", true, c1.IsClosed())
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(c1.Err()))
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		// Without compression, both ends frame the echoed messages identically.
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		for i := 0; i < 3; i++ {
+			err := wstest.Echo(tt.ctx, c1, 1024)
+			assert.Success(t, err)
+		}
+
+		c1.CloseRead(tt.ctx)
+		err := c1.Ping(tt.ctx)
+		assert.Success(t, err)
+
+		s := c1.Stats()
+		assert.Equal(t, "messages read", int64(3), s.MessagesRead)
+		assert.Equal(t, "messages written", int64(3), s.MessagesWritten)
+		assert.Equal(t, "bytes", s.BytesRead, s.BytesWritten)
+		assert.Equal(t, "pings sent", int64(1), s.PingsSent)
+		assert.Equal(t, "pongs received", int64(1), s.PongsReceived)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("compressionStats", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		msg := []byte(strings.Repeat("compressible ", 256))
+		err := c1.Write(tt.ctx, websocket.MessageText, msg)
+		assert.Success(t, err)
+		_, _, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+
+		// Streamed messages are compressed separately from Write.
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		_, err = w.Write(msg)
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+		_, _, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+
+		s := c1.Stats()
+		assert.Equal(t, "uncompressed bytes written", int64(len(msg)*2), s.UncompressedBytesWritten)
+		assert.Equal(t, "uncompressed bytes read", int64(len(msg)*2), s.UncompressedBytesRead)
+		if s.CompressedBytesWritten == 0 || s.CompressedBytesWritten >= s.UncompressedBytesWritten {
+			t.Fatalf("unexpected compressed bytes written: %v", s.CompressedBytesWritten)
+		}
+		if s.CompressedBytesRead == 0 || s.CompressedBytesRead >= s.UncompressedBytesRead {
+			t.Fatalf("unexpected compressed bytes read: %v", s.CompressedBytesRead)
+		}
+
+		c1.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("simultaneousClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		codes := map[*websocket.Conn]websocket.StatusCode{
+			c1: websocket.StatusGoingAway,
+			c2: websocket.StatusNormalClosure,
+		}
+		peers := map[*websocket.Conn]*websocket.Conn{
+			c1: c2,
+			c2: c1,
+		}
+
+		errs := make(chan error, 2)
+		for c, code := range codes {
+			c, code := c, code
+			go func() {
+				errs <- c.Close(code, "")
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+
+		for c, code := range codes {
+			err := c.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+			if errors.Is(err, websocket.ErrPeerClosed) {
+				code = codes[peers[c]]
+			}
+			assert.Equal(t, "close status", code, websocket.CloseStatus(err))
+		}
+	})
+
+	t.Run("closeWhileClosing", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+
+		// c1's close frame cannot be written until c2 reads so c2's
+		// close frame is received while c1's is still being written.
+		errs := xsync.Go(func() error {
+			return c1.Close(websocket.StatusGoingAway, "")
+		})
+		for !c1.WroteClose() {
+			runtime.Gosched()
+		}
+
+		err := c2.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Equal(t, "peer closed", false, errors.Is(err, websocket.ErrPeerClosed))
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
+	})
+
+	t.Run("readBuffer", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		var buf bytes.Buffer
+		for _, msg := range []string{"hello world", "hi"} {
+			err := c1.Write(tt.ctx, websocket.MessageBinary, []byte(msg))
+			assert.Success(t, err)
+
+			typ, err := c1.ReadBuffer(tt.ctx, &buf)
+			assert.Success(t, err)
+			assert.Equal(t, "read type", websocket.MessageBinary, typ)
+			assert.Equal(t, "read msg", msg, buf.String())
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("invalidMessageType", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		err := c1.Write(tt.ctx, websocket.MessageType(3), []byte("hi"))
+		assert.Contains(t, err, "unexpected message type: MessageType(3)")
+
+		// The connection is still usable.
+		err = wstest.Echo(tt.ctx, c1, 1024)
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("rand", func(t *testing.T) {
+		t.Parallel()
+
+		r := &countReader{}
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			Rand: r,
+		}, nil)
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		handshakeReads := r.Reads()
+		if handshakeReads == 0 {
+			t.Fatal("expected Rand to be used for the handshake key")
+		}
+
+		errs := xsync.Go(func() error {
+			return c1.Write(context.Background(), websocket.MessageText, []byte("hi"))
+		})
+		_, b, err := c2.Read(context.Background())
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "hi", string(b))
+		assert.Success(t, <-errs)
+
+		if r.Reads() == handshakeReads {
+			t.Fatal("expected Rand to be used for the masking key")
+		}
+
+		c2.CloseRead(context.Background())
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeMessages", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		exp := make([][]byte, 100)
+		for i := range exp {
+			exp[i] = xrand.Bytes(xrand.Int(64))
+		}
+
+		errs := xsync.Go(func() error {
+			return c1.WriteMessages(tt.ctx, websocket.MessageBinary, exp)
+		})
+
+		for i := range exp {
+			typ, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "msg type", websocket.MessageBinary, typ)
+			assert.Equal(t, "msg", exp[i], b)
+		}
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+		assert.Equal(t, "messages written", int64(len(exp)), c1.Stats().MessagesWritten)
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeMessagesCompressed", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 1,
+		}, &websocket.AcceptOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 1,
+		})
+		defer tt.cleanup()
+
+		exp := make([][]byte, 100)
+		for i := range exp {
+			exp[i] = []byte(strings.Repeat("hello ", xrand.Int(16)))
+		}
+
+		errs := xsync.Go(func() error {
+			return c1.WriteMessages(tt.ctx, websocket.MessageText, exp)
+		})
+
+		for i := range exp {
+			typ, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "msg type", websocket.MessageText, typ)
+			assert.Equal(t, "msg", exp[i], b)
+		}
+		assert.Success(t, <-errs)
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeFragmented", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		fragments := [][]byte{[]byte("frag"), nil, []byte("men"), []byte("ted")}
+		err := c1.WriteFragmented(tt.ctx, websocket.MessageText, fragments)
+		assert.Success(t, err)
+
+		typ, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read type", websocket.MessageText, typ)
+		assert.Equal(t, "read msg", []byte("fragmented"), b)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		readErr := xsync.Go(func() error {
+			_, b, err := c2.Read(tt.ctx)
+			if err != nil {
+				return err
+			}
+			if string(b) != "in flight" {
+				return fmt.Errorf("unexpected msg: %q", b)
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		_, err = w.Write([]byte("in "))
+		assert.Success(t, err)
+
+		c1.CloseRead(tt.ctx)
+		drainErr := xsync.Go(func() error {
+			return c1.Drain(tt.ctx)
+		})
+
+		_, err = w.Write([]byte("flight"))
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+
+		for _, errs := range []<-chan error{drainErr, readErr} {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("too late"))
+		assert.Error(t, err)
+	})
+
+	t.Run("closeHandler", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		received := make(chan websocket.CloseError, 1)
+		c1.SetCloseHandler(func(ce websocket.CloseError) {
+			received <- ce
+		})
+		c1.CloseRead(tt.ctx)
+
+		err := c2.Close(websocket.StatusGoingAway, "bye")
+		assert.Success(t, err)
+
+		select {
+		case ce := <-received:
+			assert.Equal(t, "close error", websocket.CloseError{
+				Code:   websocket.StatusGoingAway,
+				Reason: "bye",
+			}, ce)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("utf8Validation", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetUTF8Validation(true)
+
+		errs := xsync.Go(func() error {
+			// A rune split across frames is still valid.
+			err := c2.WriteFragmented(tt.ctx, websocket.MessageText, [][]byte{
+				[]byte("h\xc3"), []byte("\xa9llo"),
+			})
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageText, []byte("h\xffllo"))
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusInvalidFramePayloadData, err)
+		})
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "héllo", string(b))
+
+		_, _, err = c1.Read(tt.ctx)
+		assert.Contains(t, err, "invalid UTF-8")
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("readDuringClose", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := wstest.Pipe(nil, nil)
+		defer c2.Underlying().Close()
+
+		readErr := xsync.Go(func() error {
+			_, b, err := c1.Read(context.Background())
+			if err == nil {
+				return fmt.Errorf("unexpected message read during close: %q", b)
+			}
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+
+		closeErr := xsync.Go(func() error {
+			return c1.Close(websocket.StatusNormalClosure, "")
+		})
+
+		// Our close frame without a reason is 8 bytes as it is masked.
+		_, err := io.ReadFull(c2.Underlying(), make([]byte, 8))
+		assert.Success(t, err)
+
+		// A text message, a ping and then the close frame from the peer.
+		_, err = c2.Underlying().Write([]byte{
+			0x81, 2, 'h', 'i',
+			0x89, 0,
+			0x88, 2, 0x03, 0xe8,
+		})
+		assert.Success(t, err)
+
+		assert.Success(t, <-readErr)
+		assert.Success(t, <-closeErr)
+	})
+
+	t.Run("pongHandler", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := wstest.Pipe(nil, nil)
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		received := make(chan string, 1)
+		c1.SetPongHandler(func(p []byte) {
+			received <- string(p)
+		})
+		ctx := c1.CloseRead(context.Background())
+		c2.CloseRead(context.Background())
+
+		// An unsolicited pong as sent by a server.
+		go c2.Underlying().Write([]byte{0x8a, 9, 'h', 'e', 'a', 'r', 't', 'b', 'e', 'a', 't'})
+
+		select {
+		case p := <-received:
+			assert.Equal(t, "payload", "heartbeat", p)
+		case <-ctx.Done():
+			t.Fatal(c1.Err())
+		}
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("pingInterval", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetPingInterval(time.Millisecond * 10)
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		time.Sleep(time.Millisecond * 100)
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("touch", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetPingInterval(time.Millisecond * 50)
+		ctx := c1.CloseRead(tt.ctx)
+
+		// The peer never reads so a ping would time out and close
+		// the connection. Touching keeps deferring it.
+		for i := 0; i < 10; i++ {
+			c1.Touch()
+			time.Sleep(time.Millisecond * 10)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("connection closed despite being touched")
+		default:
+		}
+	})
+
+	t.Run("pingIntervalTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetPingInterval(time.Millisecond * 10)
+		ctx := c1.CloseRead(tt.ctx)
+
+		// The peer never reads so the ping is never answered.
+		select {
+		case <-ctx.Done():
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err := c1.Ping(tt.ctx)
+		assert.Contains(t, err, "timed out")
+	})
+
+	t.Run("bufferSizes", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			ReadBufferSize:  64 << 10,
+			WriteBufferSize: 512,
+		}, &websocket.AcceptOptions{
+			ReadBufferSize:  512,
+			WriteBufferSize: 64 << 10,
+		})
+		defer tt.cleanup()
+
+		c1.SetReadLimit(1 << 20)
+		c2.SetReadLimit(1 << 20)
+		tt.goEchoLoop(c2)
+
+		for _, n := range []int{1, 511, 4097, 1 << 17} {
+			exp := xrand.Bytes(n)
+			writeErr := xsync.Go(func() error {
+				return c1.Write(tt.ctx, websocket.MessageBinary, exp)
+			})
+
+			_, act, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", exp, act)
+
+			err = <-writeErr
+			assert.Success(t, err)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		err := c1.WriteClose(tt.ctx, make([]byte, 126))
+		assert.Contains(t, err, "exceeds the maximum of 125 bytes")
+		err = c1.WriteClose(tt.ctx, []byte{0x03})
+		assert.Contains(t, err, "invalid close payload")
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			var ce websocket.CloseError
+			if !errors.As(err, &ce) {
+				return fmt.Errorf("expected CloseError: %w", err)
+			}
+			if ce.Code != 4000 || ce.Reason != "graphql" {
+				return fmt.Errorf("unexpected close error: %v", ce)
+			}
+			return nil
+		})
+
+		err = c1.WriteClose(tt.ctx, append([]byte{0x0f, 0xa0}, "graphql"...))
+		assert.Success(t, err)
+
+		select {
+		case err := <-readErr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("peerClosed", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		ctx := c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		err := c2.Close(websocket.StatusGoingAway, "bye")
+		assert.Success(t, err)
+		<-ctx.Done()
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Equal(t, "peer closed", true, errors.Is(err, websocket.ErrPeerClosed))
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
+
+		err = c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Equal(t, "peer closed", false, errors.Is(err, websocket.ErrPeerClosed))
+	})
+
+	t.Run("rawCompressedContextTakeover", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		err := c1.WriteRaw(tt.ctx, websocket.FrameHeader{
+			Type:       websocket.MessageText,
+			Fin:        true,
+			Compressed: true,
+		}, []byte("hi"))
+		assert.Contains(t, err, "cannot write compressed frame with context takeover")
+
+		_, _, err = c2.ReadRaw(tt.ctx)
+		assert.Contains(t, err, "cannot read raw frames with context takeover")
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("rawSequencing", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		errs := xsync.Go(func() error {
+			_, err := c1.WriteFrame(tt.ctx, false, websocket.OpText, []byte("a"))
+			if err != nil {
+				return err
+			}
+			// Flushes the frame.
+			_, err = c1.WriteFrame(tt.ctx, true, websocket.OpPong, nil)
+			return err
+		})
+
+		h, p, err := c2.ReadRaw(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "fin", false, h.Fin)
+		assert.Equal(t, "payload", "a", string(p))
+		assert.Success(t, <-errs)
+
+		// Reader must not start a new message in the middle of a raw one.
+		_, _, err = c2.Read(tt.ctx)
+		assert.Contains(t, err, "previous message not read to completion")
+	})
+
+	t.Run("rawUnexpectedFrame", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusProtocolError, err)
+		})
+		errs := xsync.Go(func() error {
+			_, err := c1.WriteFrame(tt.ctx, false, websocket.OpText, []byte("a"))
+			if err != nil {
+				return err
+			}
+			_, err = c1.WriteFrame(tt.ctx, true, websocket.OpText, []byte("b"))
+			return err
+		})
+
+		_, _, err := c2.ReadRaw(tt.ctx)
+		assert.Success(t, err)
+		_, _, err = c2.ReadRaw(tt.ctx)
+		assert.Contains(t, err, "received new data message without finishing the previous message")
+		assert.Equal(t, "protocol violation", true, errors.Is(err, websocket.ErrProtocolViolation))
+		assert.Success(t, <-errs)
+		assert.Success(t, <-readErr)
+	})
+
+	t.Run("rawContinuationWithoutMessage", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusProtocolError, err)
+		})
+		errs := xsync.Go(func() error {
+			_, err := c1.WriteFrame(tt.ctx, true, websocket.OpContinuation, []byte("a"))
+			return err
+		})
+
+		_, _, err := c2.ReadRaw(tt.ctx)
+		assert.Contains(t, err, "received continuation frame without text or binary frame")
+		assert.Equal(t, "protocol violation", true, errors.Is(err, websocket.ErrProtocolViolation))
+		assert.Success(t, <-errs)
+		assert.Success(t, <-readErr)
+	})
+
+	t.Run("rawProxy", func(t *testing.T) {
+		dopts := &websocket.DialOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		}
+		aopts := &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		}
+		tt, c1, c2 := newConnTest(t, dopts, aopts)
+		defer tt.cleanup()
+		p1, p2 := wstest.Pipe(dopts, aopts)
+		defer p1.Close(websocket.StatusInternalError, "")
+		defer p2.Close(websocket.StatusInternalError, "")
+
+		// Proxies every frame from c2 to p1 as is.
+		proxyErr := xsync.Go(func() error {
+			for {
+				h, p, err := c2.ReadRaw(tt.ctx)
+				if err != nil {
+					return err
+				}
+				err = p1.WriteRaw(tt.ctx, h, p)
+				if err != nil {
+					return err
+				}
+			}
+		})
+
+		msgs := []string{strings.Repeat("compressed ", 100), "hi"}
+		writeErr := xsync.Go(func() error {
+			for _, msg := range msgs {
+				w, err := c1.Writer(tt.ctx, websocket.MessageText)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(w, msg)
+				if err != nil {
+					return err
+				}
+				err = w.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, msg := range msgs {
+			typ, b, err := p2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read type", websocket.MessageText, typ)
+			assert.Equal(t, "read msg", msg, string(b))
+		}
+		assert.Success(t, <-writeErr)
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(<-proxyErr))
+
+		p2.CloseRead(tt.ctx)
+		err = p1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("netConn", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		// Does not give any confidence but at least ensures no crashes.
+		d, _ := tt.ctx.Deadline()
+		n1.SetDeadline(d)
+		n1.SetDeadline(time.Time{})
+
+		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
+		assert.Equal(t, "remote addr string", "websocket/unknown-addr", n1.RemoteAddr().String())
+		assert.Equal(t, "remote addr network", "websocket", n1.RemoteAddr().Network())
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := ioutil.ReadAll(n1)
+		assert.Success(t, err)
+
+		_, err = n1.Read(nil)
+		assert.Equal(t, "read error", err, io.EOF)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		assert.Equal(t, "read msg", []byte("hello"), b)
+	})
+
+	t.Run("messageConn", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		m1 := websocket.MessageConn(tt.ctx, c1, websocket.MessageBinary)
+		m2 := websocket.MessageConn(tt.ctx, c2, websocket.MessageBinary)
+
+		errs := xsync.Go(func() error {
+			for _, msg := range []string{"hello", "hi", "too long", "bye"} {
+				_, err := m2.Write([]byte(msg))
+				if err != nil {
+					return err
+				}
+			}
+			return m2.Close()
+		})
+
+		p := make([]byte, 5)
+		for _, msg := range []string{"hello", "hi"} {
+			n, err := m1.Read(p)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, string(p[:n]))
+		}
+
+		n, err := m1.Read(p)
+		assert.Equal(t, "short buffer", true, errors.Is(err, io.ErrShortBuffer))
+		assert.Equal(t, "read msg", "too l", string(p[:n]))
+
+		n, err = m1.Read(p)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "bye", string(p[:n]))
+
+		_, err = m1.Read(p)
+		assert.Equal(t, "read error", io.EOF, err)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("netConn/BadMsg", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return nil
+		})
+
+		_, err := ioutil.ReadAll(n1)
+		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("writerFlush", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		flushed := make(chan struct{})
+		errs := xsync.Go(func() error {
+			w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte("hi"))
+			if err != nil {
+				return err
+			}
+			err = w.(interface{ Flush() error }).Flush()
+			if err != nil {
+				return err
+			}
+			<-flushed
+			_, err = w.Write([]byte(" there"))
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		})
+
+		// Without the flush, the first frame would not
+		// be received until the writer is closed.
+		_, r, err := c2.Reader(tt.ctx)
+		assert.Success(t, err)
+		b := make([]byte, 2)
+		_, err = io.ReadFull(r, b)
+		assert.Success(t, err)
+		assert.Equal(t, "first frame", "hi", string(b))
+		close(flushed)
+
+		b, err = ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "rest of msg", " there", string(b))
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		c1.CloseRead(tt.ctx)
+		err = c2.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writerReadFrom", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(1 << 30)
+
+		exp := xrand.Bytes(1 << 17)
+
+		werr := xsync.Go(func() error {
+			w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			// LimitReader hides bytes.Reader's WriterTo
+			// so that io.Copy uses ReadFrom.
+			n, err := io.Copy(w, io.LimitReader(bytes.NewReader(exp), int64(len(exp))))
+			if err != nil {
+				return err
+			}
+			if n != int64(len(exp)) {
+				return fmt.Errorf("expected to copy %v bytes but copied %v", len(exp), n)
+			}
+			return w.Close()
+		})
+
+		_, act, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeFrom", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(1 << 30)
+
+		exp := xrand.Bytes(1 << 17)
+		werr := xsync.Go(func() error {
+			n, err := c1.WriteFrom(tt.ctx, websocket.MessageBinary, bytes.NewReader(exp))
+			if err != nil {
+				return err
+			}
+			if n != int64(len(exp)) {
+				return fmt.Errorf("expected to write %v bytes but wrote %v", len(exp), n)
+			}
+			return nil
+		})
 
-		err := c1.Close(websocket.StatusNormalClosure, "")
+		_, act, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+		assert.Success(t, <-werr)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
 		assert.Success(t, err)
 	})
 
-	t.Run("concurrentWriteError", func(t *testing.T) {
-		tt, c1, _ := newConnTest(t, nil, nil)
+	t.Run("writeFromError", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		_, err := c1.Writer(tt.ctx, websocket.MessageText)
-		assert.Success(t, err)
+		readErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return err
+		})
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
-		defer cancel()
+		r := io.MultiReader(strings.NewReader("partial"), errReader{errors.New("boom")})
+		_, err := c1.WriteFrom(tt.ctx, websocket.MessageText, r)
+		assert.Contains(t, err, "boom")
 
-		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
-		assert.Equal(t, "write error", context.DeadlineExceeded, err)
+		err = <-readErr
+		assert.Equal(t, "close status", websocket.StatusInternalError, websocket.CloseStatus(err))
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+		assert.Contains(t, err, "boom")
 	})
 
-	t.Run("netConn", func(t *testing.T) {
+	t.Run("wsjson", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+		tt.goEchoLoop(c2)
 
-		// Does not give any confidence but at least ensures no crashes.
-		d, _ := tt.ctx.Deadline()
-		n1.SetDeadline(d)
-		n1.SetDeadline(time.Time{})
+		c1.SetReadLimit(1 << 30)
 
-		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
-		assert.Equal(t, "remote addr string", "websocket/unknown-addr", n1.RemoteAddr().String())
-		assert.Equal(t, "remote addr network", "websocket", n1.RemoteAddr().Network())
+		exp := xrand.String(xrand.Int(131072))
 
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
-			if err != nil {
-				return err
-			}
-			return n2.Close()
+		werr := xsync.Go(func() error {
+			return wsjson.Write(tt.ctx, c1, exp)
 		})
 
-		b, err := ioutil.ReadAll(n1)
+		var act interface{}
+		err := wsjson.Read(tt.ctx, c1, &act)
 		assert.Success(t, err)
-
-		_, err = n1.Read(nil)
-		assert.Equal(t, "read error", err, io.EOF)
+		assert.Equal(t, "read msg", exp, act)
 
 		select {
-		case err := <-errs:
+		case err := <-werr:
 			assert.Success(t, err)
 		case <-tt.ctx.Done():
 			t.Fatal(tt.ctx.Err())
 		}
 
-		assert.Equal(t, "read msg", []byte("hello"), b)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
 	})
 
-	t.Run("netConn/BadMsg", func(t *testing.T) {
+	t.Run("wsjsonCodec", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
+		tt.goEchoLoop(c2)
 
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
+		c1.SetReadLimit(1 << 30)
+
+		// The large message grows the buffers past what the Codec reuses.
+		var cd wsjson.Codec
+		for _, exp := range []string{xrand.String(128 << 10), "small"} {
+			werr := xsync.Go(func() error {
+				return cd.Write(tt.ctx, c1, exp)
+			})
+
+			var act string
+			err := cd.Read(tt.ctx, c1, &act)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", exp, act)
+			assert.Success(t, <-werr)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("wsjsonWithType", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		werr := xsync.Go(func() error {
+			err := c2.Write(tt.ctx, websocket.MessageBinary, []byte(`"binary"`))
 			if err != nil {
 				return err
 			}
-			return nil
+			return wsjson.Write(tt.ctx, c2, "text")
 		})
 
-		_, err := ioutil.ReadAll(n1)
-		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+		var act string
+		typ, err := wsjson.ReadWithType(tt.ctx, c1, &act)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageBinary, typ)
+		assert.Equal(t, "read msg", "binary", act)
 
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
-		}
+		typ, err = wsjson.ReadWithType(tt.ctx, c1, &act)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		assert.Equal(t, "read msg", "text", act)
+		assert.Success(t, <-werr)
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
 	})
 
-	t.Run("wsjson", func(t *testing.T) {
+	t.Run("wsjsonStream", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		tt.goEchoLoop(c2)
-
 		c1.SetReadLimit(1 << 30)
 
-		exp := xrand.String(xrand.Int(131072))
+		exp := make([]string, 1024)
+		for i := range exp {
+			exp[i] = xrand.String(xrand.Int(128))
+		}
 
 		werr := xsync.Go(func() error {
-			return wsjson.Write(tt.ctx, c1, exp)
+			err := wsjson.Write(tt.ctx, c2, exp)
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageBinary, []byte("{}"))
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusUnsupportedData, err)
 		})
 
-		var act interface{}
-		err := wsjson.Read(tt.ctx, c1, &act)
+		var act []string
+		err := wsjson.ReadStream(tt.ctx, c1, &act)
 		assert.Success(t, err)
 		assert.Equal(t, "read msg", exp, act)
 
+		err = wsjson.ReadStream(tt.ctx, c1, &act)
+		assert.Contains(t, err, "expected text message")
+
 		select {
 		case err := <-werr:
 			assert.Success(t, err)
 		case <-tt.ctx.Done():
 			t.Fatal(tt.ctx.Err())
 		}
-
-		err = c1.Close(websocket.StatusNormalClosure, "")
-		assert.Success(t, err)
 	})
 
 	t.Run("wspb", func(t *testing.T) {
@@ -383,11 +2705,19 @@ func BenchmarkConn(b *testing.B) {
 	var benchCases = []struct {
 		name string
 		mode websocket.CompressionMode
+		// perCallCtx gives every Write and Reader call its own context
+		// with a deadline as handed to timeoutLoop back to back.
+		perCallCtx bool
 	}{
 		{
 			name: "disabledCompress",
 			mode: websocket.CompressionDisabled,
 		},
+		{
+			name:       "disabledCompressPerCallCtx",
+			mode:       websocket.CompressionDisabled,
+			perCallCtx: true,
+		},
 		{
 			name: "compress",
 			mode: websocket.CompressionContextTakeover,
@@ -417,10 +2747,20 @@ func BenchmarkConn(b *testing.B) {
 			defer close(writes)
 			werrs := make(chan error)
 
+			opCtx := func() (context.Context, context.CancelFunc) {
+				if bc.perCallCtx {
+					return context.WithTimeout(bb.ctx, time.Minute)
+				}
+				return bb.ctx, func() {}
+			}
+
 			go func() {
 				for range writes {
+					ctx, cancel := opCtx()
+					err := c1.Write(ctx, websocket.MessageText, msg)
+					cancel()
 					select {
-					case werrs <- c1.Write(bb.ctx, websocket.MessageText, msg):
+					case werrs <- err:
 					case <-bb.ctx.Done():
 						return
 					}
@@ -436,7 +2776,8 @@ func BenchmarkConn(b *testing.B) {
 					b.Fatal(bb.ctx.Err())
 				}
 
-				typ, r, err := c1.Reader(bb.ctx)
+				ctx, cancel := opCtx()
+				typ, r, err := c1.Reader(ctx)
 				if err != nil {
 					b.Fatal(err)
 				}
@@ -457,6 +2798,7 @@ func BenchmarkConn(b *testing.B) {
 					assert.Equal(b, "n2", 0, n2)
 				}
 
+				cancel()
 				if !bytes.Equal(msg, readBuf) {
 					assert.Equal(b, "msg", msg, readBuf)
 				}
@@ -481,6 +2823,89 @@ func BenchmarkConn(b *testing.B) {
 	}
 }
 
+func BenchmarkRead(b *testing.B) {
+	bb, c1, c2 := newConnTest(b, &websocket.DialOptions{
+		CompressionMode: websocket.CompressionDisabled,
+	}, nil)
+	defer bb.cleanup()
+
+	msg := xrand.Bytes(64)
+	writeErr := xsync.Go(func() error {
+		for i := 0; i < b.N; i++ {
+			err := c2.Write(bb.ctx, websocket.MessageBinary, msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := c1.Read(bb.ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	assert.Success(b, <-writeErr)
+
+	c2.CloseRead(bb.ctx)
+	err := c1.Close(websocket.StatusNormalClosure, "")
+	assert.Success(b, err)
+}
+
+func BenchmarkPing(b *testing.B) {
+	bb, c1, c2 := newConnTest(b, nil, nil)
+	defer bb.cleanup()
+
+	c1.CloseRead(bb.ctx)
+	c2.CloseRead(bb.ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c1.Ping(bb.ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	err := c1.Close(websocket.StatusNormalClosure, "")
+	assert.Success(b, err)
+}
+
+func BenchmarkWSJSON(b *testing.B) {
+	bb, c1, c2 := newConnTest(b, &websocket.DialOptions{
+		CompressionMode: websocket.CompressionDisabled,
+	}, nil)
+	defer bb.cleanup()
+
+	bb.goDiscardLoop(c2)
+
+	v := map[string]interface{}{
+		"id":     42,
+		"method": "subscribe",
+		"params": []string{"a", "b", "c"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := wsjson.Write(bb.ctx, c1, v)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	err := c1.Close(websocket.StatusNormalClosure, "")
+	assert.Success(b, err)
+}
+
 func echoServer(w http.ResponseWriter, r *http.Request, opts *websocket.AcceptOptions) (err error) {
 	defer errd.Wrap(&err, "echo server failed")
 
@@ -527,3 +2952,215 @@ func TestGin(t *testing.T) {
 	err = c.Close(websocket.StatusNormalClosure, "")
 	assert.Success(t, err)
 }
+
+func TestDialConnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := echoServer(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The connection must outlive the context bounding the connect.
+	c, _, err := websocket.Dial(ctx, s.URL, &websocket.DialOptions{
+		ConnectTimeout: time.Second * 10,
+	})
+	assert.Success(t, err)
+	defer c.Close(websocket.StatusInternalError, "")
+
+	err = wstest.Echo(ctx, c, 1024)
+	assert.Success(t, err)
+
+	err = c.Close(websocket.StatusNormalClosure, "")
+	assert.Success(t, err)
+}
+
+func TestDialProxy(t *testing.T) {
+	t.Parallel()
+
+	var connects int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt64(&connects, 1)
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+
+		nc, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer nc.Close()
+		_, err = io.WriteString(nc, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			return
+		}
+
+		go io.Copy(target, nc)
+		io.Copy(nc, target)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.Success(t, err)
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := echoServer(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	testCases := []struct {
+		name string
+		s    *httptest.Server
+	}{
+		{
+			name: "ws",
+			s:    httptest.NewServer(echo),
+		},
+		{
+			name: "wss",
+			s:    httptest.NewTLSServer(echo),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			defer tc.s.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+
+			before := atomic.LoadInt64(&connects)
+			c, _, err := websocket.Dial(ctx, tc.s.URL, &websocket.DialOptions{
+				HTTPClient: tc.s.Client(),
+				Proxy:      http.ProxyURL(proxyURL),
+			})
+			assert.Success(t, err)
+			defer c.Close(websocket.StatusInternalError, "")
+			assert.Equal(t, "connects", before+1, atomic.LoadInt64(&connects))
+
+			err = wstest.Echo(ctx, c, 1024)
+			assert.Success(t, err)
+
+			err = c.Close(websocket.StatusNormalClosure, "")
+			assert.Success(t, err)
+		})
+	}
+}
+
+func TestDialTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := echoServer(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The server's certificate is not trusted by default.
+	_, _, err := websocket.Dial(ctx, s.URL, nil)
+	assert.Contains(t, err, "certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	c, _, err := websocket.Dial(ctx, s.URL, &websocket.DialOptions{
+		TLSConfig: &tls.Config{
+			RootCAs: roots,
+			// The certificate is valid for example.com
+			// while the server listens on 127.0.0.1.
+			ServerName: "example.com",
+		},
+	})
+	assert.Success(t, err)
+	defer c.Close(websocket.StatusInternalError, "")
+
+	err = wstest.Echo(ctx, c, 1024)
+	assert.Success(t, err)
+
+	err = c.Close(websocket.StatusNormalClosure, "")
+	assert.Success(t, err)
+}
+
+func TestDialTLSConfigRejected(t *testing.T) {
+	t.Parallel()
+
+	closed := make(chan struct{})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	s.Config.ConnState = func(nc net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			close(closed)
+		}
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	_, _, err := websocket.Dial(ctx, s.URL, &websocket.DialOptions{
+		TLSConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "example.com",
+		},
+	})
+	assert.Contains(t, err, "101")
+
+	// The Transport copied for TLSConfig must not keep the connection idle.
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("connection of rejected handshake left open")
+	}
+}
+
+// countReader is a deterministic io.Reader that counts its reads.
+type countReader struct {
+	reads int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n := atomic.AddInt64(&r.reads, 1)
+	for i := range p {
+		p[i] = byte(n)
+	}
+	return len(p), nil
+}
+
+func (r *countReader) Reads() int64 {
+	return atomic.LoadInt64(&r.reads)
+}
+
+// errReader is an io.Reader that always fails with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -7,15 +7,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket/internal/errd"
@@ -28,6 +32,32 @@ type DialOptions struct {
 	// http.Transport does beginning with Go 1.12.
 	HTTPClient *http.Client
 
+	// Proxy returns the URL of the HTTP proxy to tunnel the connection through
+	// for the given handshake request or nil to connect directly.
+	// The tunnel is established with CONNECT for both ws and wss URLs. For the
+	// latter, TLS runs over the tunnel. Credentials in the proxy URL are sent
+	// with Proxy-Authorization.
+	//
+	// Use http.ProxyFromEnvironment to honor the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables.
+	//
+	// HTTPClient's Transport must be nil or an *http.Transport as the proxy
+	// replaces how it dials. Its own Proxy is not used.
+	//
+	// Defaults to the Proxy of HTTPClient's Transport which with
+	// http.DefaultTransport only tunnels wss URLs through the proxy.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLSConfig is the TLS configuration used for wss URLs. Use it to trust
+	// a private CA with RootCAs, to present client certificates for mutual TLS
+	// or to override the server name used for SNI and verification with ServerName.
+	//
+	// HTTPClient's Transport must be nil or an *http.Transport as TLSConfig
+	// replaces its TLSClientConfig.
+	//
+	// Defaults to the TLSClientConfig of HTTPClient's Transport.
+	TLSConfig *tls.Config
+
 	// HTTPHeader specifies the HTTP headers included in the handshake request.
 	HTTPHeader http.Header
 
@@ -45,6 +75,68 @@ type DialOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionMinSavings is the number of bytes compression must save for
+	// a message written with Write to be sent compressed. Messages that do not
+	// compress well enough, such as already compressed media, are sent
+	// uncompressed instead.
+	//
+	// Defaults to 0 which sends a message compressed whenever that makes it smaller.
+	// Messages written with Writer are always compressed once over the threshold.
+	CompressionMinSavings int
+
+	// HandshakeTimeout bounds the time spent performing the WebSocket handshake.
+	// It is applied in addition to the context passed to Dial but only
+	// while dialing and waiting for the handshake response.
+	//
+	// Defaults to no timeout.
+	HandshakeTimeout time.Duration
+
+	// ConnectTimeout bounds the time spent establishing the connection the
+	// handshake request is sent on. That includes the TCP connect, the proxy
+	// tunnel and the TLS handshake but not waiting for the handshake response.
+	// It only applies when a new connection is established and is reported
+	// separately from HandshakeTimeout so that a server that accepts connections
+	// but is slow to upgrade them can be told apart from one that is unreachable.
+	//
+	// The HTTPClient's Transport must support httptrace.ClientTrace's GotConn
+	// as http.Transport does.
+	//
+	// Defaults to no timeout.
+	ConnectTimeout time.Duration
+
+	// DisableFinalizer disables the finalizer that closes the connection
+	// if it is garbage collected without Close being called.
+	//
+	// The finalizer guards against leaking the underlying connection but adds
+	// GC overhead per connection and can hide missing Close calls. Only disable
+	// it if every connection is reliably closed.
+	DisableFinalizer bool
+
+	// MemoryLimiter bounds the memory used to read messages across all connections
+	// sharing it. See the docs on MemoryLimiter.
+	MemoryLimiter *MemoryLimiter
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers used to
+	// read from and write to the underlying connection.
+	//
+	// Larger buffers reduce the number of syscalls for high throughput streams
+	// at the cost of memory held by every connection for its lifetime.
+	// Only buffers of the default size are pooled and reused between connections.
+	//
+	// Both default to 4096.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Rand is the source of randomness for the Sec-WebSocket-Key and
+	// the masking keys of frames. It must be safe for concurrent use
+	// if shared between connections.
+	//
+	// RFC 6455 requires masking keys to be unpredictable so only use
+	// a deterministic source for reproducible tests.
+	//
+	// Defaults to crypto/rand.Reader.
+	Rand io.Reader
 }
 
 // Dial performs a WebSocket handshake on url.
@@ -79,6 +171,9 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		opts.HTTPHeader = http.Header{}
 	}
 
+	if rand == nil {
+		rand = opts.Rand
+	}
 	secWebSocketKey, err := secWebSocketKey(rand)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate Sec-WebSocket-Key: %w", err)
@@ -89,8 +184,18 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		copts = opts.CompressionMode.opts()
 	}
 
-	resp, err := handshakeRequest(ctx, urls, opts, copts, secWebSocketKey)
+	hctx := ctx
+	if opts.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, opts.HandshakeTimeout)
+		defer cancel()
+	}
+
+	resp, err := handshakeRequest(hctx, urls, opts, copts, secWebSocketKey)
 	if err != nil {
+		if hctx.Err() != nil && ctx.Err() == nil {
+			err = fmt.Errorf("handshake timed out after %v: %w", opts.HandshakeTimeout, err)
+		}
 		return nil, resp, err
 	}
 	respBody := resp.Body
@@ -121,14 +226,23 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		return nil, resp, fmt.Errorf("response body is not a io.ReadWriteCloser: %T", respBody)
 	}
 
+	// Already validated by handshakeRequest.
+	u, _ := url.Parse(urls)
+
 	return newConn(connConfig{
-		subprotocol:    resp.Header.Get("Sec-WebSocket-Protocol"),
-		rwc:            rwc,
-		client:         true,
-		copts:          copts,
-		flateThreshold: opts.CompressionThreshold,
-		br:             getBufioReader(rwc),
-		bw:             getBufioWriter(rwc),
+		subprotocol:     resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:      resp.Header.Get("Sec-WebSocket-Extensions"),
+		url:             u,
+		rwc:             rwc,
+		client:          true,
+		copts:           copts,
+		flateThreshold:  opts.CompressionThreshold,
+		flateMinSavings: opts.CompressionMinSavings,
+		memLimiter:      opts.MemoryLimiter,
+		noFinalizer:     opts.DisableFinalizer,
+		maskRand:        opts.Rand,
+		br:              getBufioReader(rwc, opts.ReadBufferSize),
+		bw:              getBufioWriter(rwc, opts.WriteBufferSize),
 	}), resp, nil
 }
 
@@ -165,13 +279,160 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 		copts.setHeader(req.Header)
 	}
 
-	resp, err := opts.HTTPClient.Do(req)
+	hc, err := httpClient(opts, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var connectTimer *time.Timer
+	var connected int32
+	if opts.ConnectTimeout > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		connectTimer = time.AfterFunc(opts.ConnectTimeout, cancel)
+		defer connectTimer.Stop()
+
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				// If the timer already fired, the request is being cancelled
+				// and the connect did not make it in time.
+				if connectTimer.Stop() {
+					atomic.StoreInt32(&connected, 1)
+				}
+			},
+		})
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := hc.Do(req)
 	if err != nil {
+		// Stop reports whether the timer had yet to fire so it cannot be
+		// blamed for an error that came first.
+		if connectTimer != nil && atomic.LoadInt32(&connected) == 0 && !connectTimer.Stop() {
+			return nil, fmt.Errorf("failed to connect within %v: %w", opts.ConnectTimeout, err)
+		}
 		return nil, fmt.Errorf("failed to send handshake request: %w", err)
 	}
 	return resp, nil
 }
 
+// httpClient returns the client to send the handshake request req with.
+// If needed for Proxy or TLSConfig, it is a copy of HTTPClient with a copy
+// of its Transport.
+func httpClient(opts *DialOptions, req *http.Request) (*http.Client, error) {
+	var proxyURL *url.URL
+	if opts.Proxy != nil {
+		var err error
+		proxyURL, err = opts.Proxy(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get proxy: %w", err)
+		}
+		if proxyURL != nil && proxyURL.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+		}
+	}
+	if proxyURL == nil && opts.TLSConfig == nil {
+		return opts.HTTPClient, nil
+	}
+
+	var t *http.Transport
+	switch rt := opts.HTTPClient.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return nil, fmt.Errorf("cannot use Proxy or TLSConfig with HTTPClient.Transport of type %T", rt)
+	}
+
+	if proxyURL != nil {
+		dial := t.DialContext
+		if dial == nil {
+			var d net.Dialer
+			dial = d.DialContext
+		}
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialProxy(ctx, dial, proxyURL, addr)
+		}
+	}
+	if opts.TLSConfig != nil {
+		t.TLSClientConfig = opts.TLSConfig.Clone()
+	}
+	// The copy only sends this request. On success its connection is taken
+	// over by the Conn but otherwise it would sit idle in the copy's pool
+	// with nothing left to close it.
+	t.DisableKeepAlives = true
+
+	hc := *opts.HTTPClient
+	hc.Transport = t
+	return &hc, nil
+}
+
+// dialProxy connects to addr through a tunnel established with CONNECT
+// by the proxy at proxyURL.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), proxyURL *url.URL, addr string) (_ net.Conn, err error) {
+	defer errd.Wrap(&err, "failed to dial through proxy")
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	nc, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			nc.Close()
+		}
+	}()
+
+	// Bounds the CONNECT request by ctx.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	err = req.Write(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy responded to CONNECT with %v", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return nil, errors.New("proxy sent data before the tunnel was used")
+	}
+	return nc, nil
+}
+
 func secWebSocketKey(rr io.Reader) (string, error) {
 	if rr == nil {
 		rr = rand.Reader
@@ -256,32 +517,57 @@ func verifyServerExtensions(copts *compressionOptions, h http.Header) (*compress
 	return copts, nil
 }
 
+// defaultBufioSize is the size of the bufio readers and writers
+// used when none is configured. Only buffers of this size are pooled
+// so that a buffer is never reused with the wrong size.
+const defaultBufioSize = 4096
+
 var bufioReaderPool sync.Pool
 
-func getBufioReader(r io.Reader) *bufio.Reader {
+func getBufioReader(r io.Reader, size int) *bufio.Reader {
+	if size <= 0 {
+		size = defaultBufioSize
+	}
+	if size != defaultBufioSize {
+		return bufio.NewReaderSize(r, size)
+	}
+
 	br, ok := bufioReaderPool.Get().(*bufio.Reader)
 	if !ok {
-		return bufio.NewReader(r)
+		return bufio.NewReaderSize(r, size)
 	}
 	br.Reset(r)
 	return br
 }
 
 func putBufioReader(br *bufio.Reader) {
+	if br.Size() != defaultBufioSize {
+		return
+	}
 	bufioReaderPool.Put(br)
 }
 
 var bufioWriterPool sync.Pool
 
-func getBufioWriter(w io.Writer) *bufio.Writer {
+func getBufioWriter(w io.Writer, size int) *bufio.Writer {
+	if size <= 0 {
+		size = defaultBufioSize
+	}
+	if size != defaultBufioSize {
+		return bufio.NewWriterSize(w, size)
+	}
+
 	bw, ok := bufioWriterPool.Get().(*bufio.Writer)
 	if !ok {
-		return bufio.NewWriter(w)
+		return bufio.NewWriterSize(w, size)
 	}
 	bw.Reset(w)
 	return bw
 }
 
 func putBufioWriter(bw *bufio.Writer) {
+	if bw.Size() != defaultBufioSize {
+		return
+	}
 	bufioWriterPool.Put(bw)
 }
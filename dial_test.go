@@ -5,10 +5,13 @@ package websocket
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -49,6 +52,23 @@ func TestBadDials(t *testing.T) {
 				name: "badTLS",
 				url:  "wss://totallyfake.nhooyr.io",
 			},
+			{
+				name: "badProxyScheme",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: "localhost:1080"}),
+				},
+			},
+			{
+				name: "badProxyTransport",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					HTTPClient: mockHTTPClient(func(*http.Request) (*http.Response, error) {
+						return nil, io.EOF
+					}),
+					Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "localhost:8080"}),
+				},
+			},
 			{
 				name: "badReader",
 				rand: func(p []byte) (int, error) {
@@ -115,6 +135,103 @@ func TestBadDials(t *testing.T) {
 		})
 		assert.Contains(t, err, "response body is not a io.ReadWriteCloser")
 	})
+
+	t.Run("handshakeTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rt := func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			HTTPClient:       mockHTTPClient(rt),
+			HandshakeTimeout: time.Millisecond * 100,
+		})
+		assert.Contains(t, err, "handshake timed out after 100ms")
+		assert.Contains(t, err, "deadline exceeded")
+	})
+
+	t.Run("connectTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rt := func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			HTTPClient:       mockHTTPClient(rt),
+			HandshakeTimeout: time.Second,
+			ConnectTimeout:   time.Millisecond * 100,
+		})
+		assert.Contains(t, err, "failed to connect within 100ms")
+	})
+
+	t.Run("connectTimeoutRacesGotConn", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		// The connection arrives after the timer fired so the
+		// request is still cut short by the connect timeout.
+		rt := func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			httptrace.ContextClientTrace(r.Context()).GotConn(httptrace.GotConnInfo{})
+			return nil, r.Context().Err()
+		}
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			HTTPClient:     mockHTTPClient(rt),
+			ConnectTimeout: time.Millisecond * 50,
+		})
+		assert.Contains(t, err, "failed to connect within 50ms")
+	})
+
+	t.Run("connectError", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rt := func(r *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			HTTPClient:     mockHTTPClient(rt),
+			ConnectTimeout: time.Second,
+		})
+		assert.Contains(t, err, "failed to send handshake request")
+		assert.Contains(t, err, "connection refused")
+	})
+
+	t.Run("handshakeTimeoutAfterConnect", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rt := func(r *http.Request) (*http.Response, error) {
+			httptrace.ContextClientTrace(r.Context()).GotConn(httptrace.GotConnInfo{})
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			HTTPClient:       mockHTTPClient(rt),
+			HandshakeTimeout: time.Millisecond * 200,
+			ConnectTimeout:   time.Millisecond * 50,
+		})
+		assert.Contains(t, err, "handshake timed out after 200ms")
+	})
 }
 
 func Test_verifyServerHandshake(t *testing.T) {
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"context"
+	"io"
+)
+
+// Echo reads messages from c and writes each back with the same
+// MessageType until ctx is cancelled or the connection is closed.
+// It returns the error that stopped it.
+//
+// It's for tests and conformance suites that need an echo peer.
+func Echo(ctx context.Context, c *Conn) error {
+	b := make([]byte, 32<<10)
+	for {
+		typ, r, err := c.Reader(ctx)
+		if err != nil {
+			return err
+		}
+
+		w, err := c.Writer(ctx, typ)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyBuffer(w, r, b)
+		if err != nil {
+			return err
+		}
+
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,6 +2,25 @@
 
 package websocket
 
+import (
+	"context"
+)
+
+type OpCode int
+
+const (
+	OpContinuation = OpCode(opContinuation)
+	OpText         = OpCode(opText)
+	OpBinary       = OpCode(opBinary)
+	OpClose        = OpCode(opClose)
+	OpPing         = OpCode(opPing)
+	OpPong         = OpCode(opPong)
+)
+
+func (c *Conn) WriteFrame(ctx context.Context, fin bool, opc OpCode, p []byte) (int, error) {
+	return c.writeFrame(ctx, fin, false, opcode(opc), p)
+}
+
 func (c *Conn) RecordBytesWritten() *int {
 	var bytesWritten int
 	c.bw.Reset(writerFunc(func(p []byte) (int, error) {
@@ -20,3 +39,9 @@ func (c *Conn) RecordBytesRead() *int {
 	}))
 	return &bytesRead
 }
+
+func (c *Conn) WroteClose() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.wroteClose
+}
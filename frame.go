@@ -31,6 +31,46 @@ const (
 	// 11-16 are reserved for further control frames.
 )
 
+// FrameHeader describes a raw WebSocket data frame.
+// See ReadRaw and WriteRaw.
+type FrameHeader struct {
+	// Type is the type of the message the frame begins.
+	// It is 0 for a continuation frame.
+	Type MessageType
+	// Fin is whether the frame is the last of its message.
+	Fin bool
+	// Compressed is whether the RSV1 bit is set which means the message
+	// the frame begins is compressed with permessage-deflate.
+	Compressed bool
+}
+
+// FrameTrace is a read only view of the header of a frame read from or
+// written to the connection. See SetFrameHooks.
+type FrameTrace struct {
+	// Opcode is the opcode of the frame as defined in RFC 6455 section 5.2.
+	// For example, 1 for a text frame and 9 for a ping.
+	Opcode int
+	Fin    bool
+	RSV1   bool
+	RSV2   bool
+	RSV3   bool
+	Masked bool
+	// Length is the payload length of the frame.
+	Length int64
+}
+
+func (h header) trace() FrameTrace {
+	return FrameTrace{
+		Opcode: int(h.opcode),
+		Fin:    h.fin,
+		RSV1:   h.rsv1,
+		RSV2:   h.rsv2,
+		RSV3:   h.rsv3,
+		Masked: h.masked,
+		Length: h.payloadLength,
+	}
+}
+
 // header represents a WebSocket frame header.
 // See https://tools.ietf.org/html/rfc6455#section-5.2.
 type header struct {
@@ -0,0 +1,23 @@
+// +build !js
+
+package wstest
+
+import (
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// EchoServer returns a handler that accepts WebSocket connections with opts
+// and echoes every message received with EchoLoop. UTF-8 validation is
+// enabled so that it can be run against the Autobahn fuzzingclient.
+func EchoServer(opts *websocket.AcceptOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, opts)
+		if err != nil {
+			return
+		}
+		c.SetUTF8Validation(true)
+		EchoLoop(r.Context(), c)
+	})
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// MemoryLimiter bounds the memory allocated to read messages across all
+// connections sharing it.
+//
+// Each connection still enforces its own read limit. A MemoryLimiter protects
+// against many connections reading messages under their limit at the same time.
+// Memory is reserved before it is allocated so when the budget is exhausted,
+// the message being read is rejected without allocating and its connection
+// closed with StatusTryAgainLater.
+//
+// Conn.Read, Conn.ReadFull, Conn.ReadBuffer and Conn.ReadRaw reserve the buffer
+// they return while the message is being read and release it once they return.
+// Conn.ReadBuffer only reserves what it grows buf by. Conn.ReadGzip reserves the
+// memory of its decompressor until the reader returns an error or is closed.
+// Conn.Reader and Conn.ReadInto do not allocate to hold the message and so are
+// not accounted for. Bounding what the application retains is up to it.
+//
+// Pass it to connections with the MemoryLimiter field of AcceptOptions or DialOptions.
+type MemoryLimiter struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewMemoryLimiter returns a MemoryLimiter with a budget of limit bytes.
+func NewMemoryLimiter(limit int64) *MemoryLimiter {
+	return &MemoryLimiter{
+		limit: limit,
+	}
+}
+
+// Used returns the number of bytes currently in use.
+func (ml *MemoryLimiter) Used() int64 {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.used
+}
+
+func (ml *MemoryLimiter) reserve(n int64) bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.used+n > ml.limit {
+		return false
+	}
+	ml.used += n
+	return true
+}
+
+func (ml *MemoryLimiter) release(n int64) {
+	ml.mu.Lock()
+	ml.used -= n
+	ml.mu.Unlock()
+}
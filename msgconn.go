@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// MessageConn converts a *websocket.Conn into an io.ReadWriteCloser that
+// preserves message boundaries.
+//
+// Unlike NetConn, every Read returns exactly one message and every Write
+// writes exactly one message of the given type. It's for protocols that
+// are inherently message based.
+//
+// If a message does not fit in the buffer passed to Read, the buffer is
+// filled, the rest of the message is discarded and an error wrapping
+// io.ErrShortBuffer is returned.
+//
+// The passed ctx bounds the lifetime of the io.ReadWriteCloser. If cancelled,
+// all reads and writes will be cancelled.
+//
+// If a message is read that is not of the correct type, the connection
+// will be closed with StatusUnsupportedData and an error will be returned.
+//
+// Close will close the *websocket.Conn with StatusNormalClosure.
+//
+// A received StatusNormalClosure or StatusGoingAway close frame will be translated to
+// io.EOF when reading.
+func MessageConn(ctx context.Context, c *Conn, msgType MessageType) io.ReadWriteCloser {
+	return &msgConn{
+		ctx:     ctx,
+		c:       c,
+		msgType: msgType,
+	}
+}
+
+type msgConn struct {
+	ctx     context.Context
+	c       *Conn
+	msgType MessageType
+
+	readMu sync.Mutex
+	eofed  bool
+}
+
+func (c *msgConn) Close() error {
+	return c.c.Close(StatusNormalClosure, "")
+}
+
+func (c *msgConn) Write(p []byte) (int, error) {
+	err := c.c.Write(c.ctx, c.msgType, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *msgConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.eofed {
+		return 0, io.EOF
+	}
+
+	typ, r, err := c.c.Reader(c.ctx)
+	if err != nil {
+		switch CloseStatus(err) {
+		case StatusNormalClosure, StatusGoingAway:
+			c.eofed = true
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	if typ != c.msgType {
+		err := fmt.Errorf("unexpected frame type read (expected %v): %v", c.msgType, typ)
+		c.c.Close(StatusUnsupportedData, err.Error())
+		return 0, err
+	}
+
+	return readInto(r, p)
+}
+
+// readInto reads the message from r into p. If the message does not fit,
+// the rest of it is discarded and an error wrapping io.ErrShortBuffer is
+// returned.
+func readInto(r io.Reader, p []byte) (int, error) {
+	n, err := io.ReadFull(r, p)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, nil
+	case nil:
+	default:
+		return n, err
+	}
+
+	// p is full so the message may continue.
+	discarded, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return n, err
+	}
+	if discarded > 0 {
+		return n, fmt.Errorf("message larger than read buffer of %v bytes: %w", len(p), io.ErrShortBuffer)
+	}
+	return n, nil
+}
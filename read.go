@@ -4,13 +4,20 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"nhooyr.io/websocket/internal/errd"
 	"nhooyr.io/websocket/internal/xsync"
@@ -27,7 +34,11 @@ import (
 //
 // Only one Reader may be open at a time.
 func (c *Conn) Reader(ctx context.Context) (MessageType, io.Reader, error) {
-	return c.reader(ctx)
+	if c.role == RoleWriteOnly {
+		return 0, nil, errors.New("failed to get reader: connection is write only")
+	}
+	ctx, cancel := withDefaultTimeout(ctx, &c.defaultReadTimeout, &c.readDeadline)
+	return c.reader(ctx, cancel)
 }
 
 // Read is a convenience method around Reader to read a single message
@@ -38,10 +49,266 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 		return 0, nil, err
 	}
 
-	b, err := ioutil.ReadAll(r)
+	res := memReservation{c: c}
+	defer res.release()
+
+	if n, ok := c.msgReader.bufferedLen(); ok {
+		// Fast path to avoid readAll's growth logic.
+		err = res.grow(n)
+		if err != nil {
+			return typ, nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return typ, b, err
+		}
+		// Completes the message.
+		_, err = r.Read(nil)
+		if err != io.EOF {
+			return typ, b, fmt.Errorf("expected EOF after fully buffered message: %w", err)
+		}
+		return typ, b, nil
+	}
+
+	b, err := readAll(r, &res, nil)
 	return typ, b, err
 }
 
+// ReadFull is like Read but closes the connection with StatusMessageTooBig
+// if the message is larger than maxSize bytes. It allows capping the size of
+// a single message below the limit set with SetReadLimit which still applies.
+//
+// When the message exceeds maxSize, the rest of it is not read and a
+// ReadLimitError with a Limit of maxSize is returned.
+//
+// A negative maxSize is an error and no message is read.
+func (c *Conn) ReadFull(ctx context.Context, maxSize int) (MessageType, []byte, error) {
+	if maxSize < 0 {
+		return 0, nil, fmt.Errorf("failed to read: max size must not be negative: %d", maxSize)
+	}
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res := memReservation{c: c}
+	defer res.release()
+
+	b, err := readAll(io.LimitReader(r, int64(maxSize)+1), &res, nil)
+	if err != nil {
+		return typ, b, err
+	}
+	if len(b) > maxSize {
+		err := ReadLimitError{Limit: int64(maxSize)}
+		c.writeError(StatusMessageTooBig, err)
+		return typ, nil, fmt.Errorf("failed to read: %w", err)
+	}
+	return typ, b, nil
+}
+
+// ReadBuffer is like Read but reads the message into buf.
+// buf is reset before reading so its backing array can be reused
+// across calls to avoid allocations.
+//
+// The read limit still applies.
+func (c *Conn) ReadBuffer(ctx context.Context, buf *bytes.Buffer) (MessageType, error) {
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	res := memReservation{c: c}
+	defer res.release()
+
+	// The existing capacity of buf is reused so only growth is reserved.
+	b, err := readAll(r, &res, buf.Bytes()[:0])
+	*buf = *bytes.NewBuffer(b)
+	return typ, err
+}
+
+// ReadInto is like Read but reads the message into buf and returns
+// the number of bytes read. It avoids allocating when messages are
+// known to fit in buf.
+//
+// If the message is larger than buf, buf is filled, the rest of the message
+// is discarded and an error wrapping io.ErrShortBuffer is returned.
+// The connection remains usable.
+func (c *Conn) ReadInto(ctx context.Context, buf []byte) (MessageType, int, error) {
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, err := readInto(r, buf)
+	return typ, n, err
+}
+
+// ReadGzip is like Reader but for messages gzipped by the application.
+// This is distinct from permessage-deflate and the two may be combined.
+//
+// The read limit applies to both the compressed and decompressed size of the message.
+// Ensure you read to EOF otherwise the connection will hang.
+func (c *Conn) ReadGzip(ctx context.Context) (MessageType, io.ReadCloser, error) {
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res := &memReservation{c: c}
+	err = res.grow(gzipReaderSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		res.release()
+		err = fmt.Errorf("failed to read gzip header: %w", err)
+		c.writeError(StatusInvalidFramePayloadData, err)
+		return 0, nil, err
+	}
+
+	lr := newLimitReader(c, gr, c.msgReader.limitReader.limit.Load())
+	lr.reset(gr)
+	return typ, &gzipReader{lr, gr, res}, nil
+}
+
+// gzipReaderSize approximates the memory held by a gzip.Reader.
+// It is dominated by the 32 KiB window of its decompressor.
+const gzipReaderSize = 40 << 10
+
+type gzipReader struct {
+	r   io.Reader
+	gr  *gzip.Reader
+	res *memReservation
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.res.release()
+	}
+	return n, err
+}
+
+func (r *gzipReader) Close() error {
+	r.res.release()
+	return r.gr.Close()
+}
+
+// ReadRaw reads the next data frame from the connection without interpreting it.
+// Control frames are handled as usual.
+//
+// Compressed frames are returned as is so that they can be passed through to
+// another connection with WriteRaw without decompressing and recompressing
+// them. For this to work, both connections must have negotiated the same
+// compression parameters without context takeover. See WriteRaw. ReadRaw
+// returns an error if context takeover was negotiated for the peer's side.
+//
+// Frames are checked to continue the message as with Reader and the filter
+// set with SetMessageFilter applies to the first frame of every message.
+// The read limit applies to every frame.
+//
+// Reader and Read cannot be called until the last frame of a message has been
+// read and ReadRaw cannot be called while a message from Reader is being read.
+func (c *Conn) ReadRaw(ctx context.Context) (_ FrameHeader, _ []byte, err error) {
+	defer errd.Wrap(&err, "failed to read raw frame")
+
+	if c.role == RoleWriteOnly {
+		return FrameHeader{}, nil, errors.New("connection is write only")
+	}
+	if c.flate() && c.msgReader.flateContextTakeover() {
+		return FrameHeader{}, nil, errors.New("cannot read raw frames with context takeover as they could not be decompressed on their own")
+	}
+
+	err = c.readMu.lock(ctx)
+	if err != nil {
+		return FrameHeader{}, nil, err
+	}
+	defer c.readMu.unlock()
+
+	mr := c.msgReader
+	if !mr.fin && !mr.raw {
+		err = errors.New("previous message not read to completion")
+		c.close(fmt.Errorf("failed to read raw frame: %w", err))
+		return FrameHeader{}, nil, err
+	}
+
+	var h header
+	for {
+		h, err = c.readLoop(ctx)
+		if err != nil {
+			return FrameHeader{}, nil, err
+		}
+		if !c.wroteCloseFrame() {
+			break
+		}
+		// See Reader.
+		err = c.discardFramePayload(ctx, h)
+		if err != nil {
+			return FrameHeader{}, nil, err
+		}
+	}
+
+	if h.opcode == opContinuation && mr.fin {
+		err := errors.New("received continuation frame without text or binary frame")
+		return FrameHeader{}, nil, c.protocolViolation(err)
+	}
+	if h.opcode != opContinuation && !mr.fin {
+		err := errors.New("received new data message without finishing the previous message")
+		return FrameHeader{}, nil, c.protocolViolation(err)
+	}
+
+	if h.opcode != opContinuation && c.msgFilter != nil {
+		err = c.msgFilter(MessageHeader{
+			Type:        MessageType(h.opcode),
+			Compressed:  h.rsv1,
+			Fin:         h.fin,
+			FrameLength: h.payloadLength,
+		})
+		if err != nil {
+			err = fmt.Errorf("message rejected: %w", err)
+			c.writeError(StatusPolicyViolation, err)
+			return FrameHeader{}, nil, err
+		}
+	}
+
+	limit := mr.limitReader.limit.Load() - 1
+	if h.payloadLength > limit {
+		err := ReadLimitError{Limit: limit}
+		c.writeError(StatusMessageTooBig, err)
+		return FrameHeader{}, nil, err
+	}
+
+	res := memReservation{c: c}
+	defer res.release()
+	err = res.grow(int(h.payloadLength))
+	if err != nil {
+		return FrameHeader{}, nil, err
+	}
+	p := make([]byte, h.payloadLength)
+	_, err = c.readFramePayload(ctx, p)
+	if err != nil {
+		return FrameHeader{}, nil, err
+	}
+	if h.masked {
+		mask(h.maskKey, p)
+	}
+
+	mr.raw = true
+	mr.infoMu.Lock()
+	mr.fin = h.fin
+	mr.payloadLength = 0
+	mr.infoMu.Unlock()
+
+	return FrameHeader{
+		Type:       MessageType(h.opcode),
+		Fin:        h.fin,
+		Compressed: h.rsv1,
+	}, p, nil
+}
+
 // CloseRead starts a goroutine to read from the connection until it is closed
 // or a data message is received.
 //
@@ -54,11 +321,18 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 // Since it actively reads from the connection, it will ensure that ping, pong and close
 // frames are responded to. This means c.Ping and c.Close will still work as expected.
 func (c *Conn) CloseRead(ctx context.Context) context.Context {
+	return c.closeRead(ctx, StatusPolicyViolation)
+}
+
+// closeRead is CloseRead but closes with code when a data message is received.
+func (c *Conn) closeRead(ctx context.Context, code StatusCode) context.Context {
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 		defer cancel()
-		c.Reader(ctx)
-		c.Close(StatusPolicyViolation, "unexpected data message")
+		// The default read timeout does not apply as CloseRead
+		// reads for the lifetime of the connection.
+		c.reader(ctx, cancel)
+		c.Close(code, "unexpected data message")
 	}()
 	return ctx
 }
@@ -66,10 +340,20 @@ func (c *Conn) CloseRead(ctx context.Context) context.Context {
 // SetReadLimit sets the max number of bytes to read for a single message.
 // It applies to the Reader and Read methods.
 //
+// For compressed messages, the limit applies to the decompressed bytes
+// which protects against decompression bombs.
+//
 // By default, the connection has a message read limit of 32768 bytes.
 //
-// When the limit is hit, the connection will be closed with StatusMessageTooBig.
+// When the limit is hit, the connection will be closed with StatusMessageTooBig
+// and a ReadLimitError returned.
+//
+// A negative n disables the limit. Only do so for trusted peers as a single
+// message can then use unbounded memory with Read.
 func (c *Conn) SetReadLimit(n int64) {
+	if n < 0 {
+		n = math.MaxInt64 - 1
+	}
 	// We add read one more byte than the limit in case
 	// there is a fin frame that needs to be read.
 	c.msgReader.limitReader.limit.Store(n + 1)
@@ -77,6 +361,127 @@ func (c *Conn) SetReadLimit(n int64) {
 
 const defaultReadLimit = 32768
 
+// SetUTF8Validation sets whether text messages are validated to be UTF-8
+// as they are read. When invalid UTF-8 is read, the connection is closed
+// with StatusInvalidFramePayloadData as required by RFC 6455.
+//
+// It is disabled by default as it costs a pass over every text message and
+// most applications validate or decode the messages themselves anyway.
+// It applies to Reader and Read but not ReadRaw.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetUTF8Validation(enabled bool) {
+	c.validateUTF8 = enabled
+}
+
+// MessageHeader describes a data message before any of it has been read.
+type MessageHeader struct {
+	Type MessageType
+	// Compressed is whether the message was compressed by the peer.
+	Compressed bool
+	// Fin is whether the message consists of a single frame.
+	Fin bool
+	// FrameLength is the payload length of the first frame of the message.
+	// For a compressed message, it is the compressed length.
+	FrameLength int64
+}
+
+// SetMessageFilter sets a function that will be called with the header of every
+// data message before it is read and decompressed.
+//
+// If the function returns an error, the message is rejected, the connection is
+// closed with StatusPolicyViolation and the error is returned from Reader.
+// Use this to reject messages you never expect to be compressed or that
+// declare a length your application would never send.
+//
+// It must not be called concurrently with Reader or Read.
+func (c *Conn) SetMessageFilter(fn func(MessageHeader) error) {
+	c.msgFilter = fn
+}
+
+// SetErrorLog sets the logger used to report protocol errors by the peer
+// in more detail than the error returned from the method that hit them.
+// This is useful when debugging interoperability with other implementations.
+//
+// Currently frames with a reserved opcode are logged with the numeric opcode.
+//
+// Internal warnings, such as failing to marshal the close frame written by Close,
+// are logged to it as well instead of to the standard logger.
+//
+// By default, protocol errors are not logged and warnings are logged with the
+// standard logger. It must be called before the connection is used.
+func (c *Conn) SetErrorLog(l *log.Logger) {
+	c.errorLog = l
+}
+
+// warnf logs an internal warning to the error log if set
+// or to the standard logger otherwise.
+func (c *Conn) warnf(format string, v ...interface{}) {
+	if c.errorLog != nil {
+		c.errorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// SetControlFrameLimit sets the max number of control frames the peer
+// may send in a second.
+//
+// By default, there is no limit.
+//
+// When the limit is hit, the connection will be closed with StatusPolicyViolation.
+// Use this to bound the work a peer can cause by flooding ping or pong frames.
+func (c *Conn) SetControlFrameLimit(n int) {
+	c.controlLimit.Store(int64(n))
+}
+
+// SetRejectedControlFrameHandler sets a function that is called with the
+// reason whenever a control frame from the peer is rejected before its payload
+// is read. That is a control frame over the 125 byte limit of RFC 6455,
+// a fragmented control frame or one over the limit set by SetControlFrameLimit.
+// The connection is closed right after.
+//
+// Use it to keep track of how often peers misbehave, e.g. with a metric.
+// It is called from the goroutine reading the connection so it must not block.
+//
+// It must be called before the connection is used.
+func (c *Conn) SetRejectedControlFrameHandler(fn func(err error)) {
+	c.rejectedControlHandler = fn
+}
+
+// controlFrameRejected calls the handler set by SetRejectedControlFrameHandler.
+func (c *Conn) controlFrameRejected(err error) {
+	if c.rejectedControlHandler != nil {
+		c.rejectedControlHandler(err)
+	}
+}
+
+// ControlFrameRate returns the number of control frames received from the peer
+// in the current one second window. It is 0 once a second has passed without
+// a control frame.
+func (c *Conn) ControlFrameRate() int {
+	if time.Since(time.Unix(0, c.controlWindowStart.Load())) >= time.Second {
+		return 0
+	}
+	return int(c.controlCount.Load())
+}
+
+// allowControlFrame records a received control frame and reports whether
+// the peer is still within the limit set by SetControlFrameLimit.
+// It must be called with readMu held.
+func (c *Conn) allowControlFrame() bool {
+	now := time.Now()
+	n := c.controlCount.Load() + 1
+	if now.Sub(time.Unix(0, c.controlWindowStart.Load())) >= time.Second {
+		c.controlWindowStart.Store(now.UnixNano())
+		n = 1
+	}
+	c.controlCount.Store(n)
+
+	limit := c.controlLimit.Load()
+	return limit <= 0 || n <= limit
+}
+
 func newMsgReader(c *Conn) *msgReader {
 	mr := &msgReader{
 		c:   c,
@@ -93,7 +498,7 @@ func (mr *msgReader) resetFlate() {
 		mr.dict.init(32768)
 	}
 	if mr.flateBufio == nil {
-		mr.flateBufio = getBufioReader(mr.readFunc)
+		mr.flateBufio = getBufioReader(mr.readFunc, 0)
 	}
 
 	mr.flateReader = getFlateReader(mr.flateBufio, mr.dict.buf)
@@ -150,12 +555,11 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 
 		if h.rsv1 && c.readRSV1Illegal(h) || h.rsv2 || h.rsv3 {
 			err := fmt.Errorf("received header with unexpected rsv bits set: %v:%v:%v", h.rsv1, h.rsv2, h.rsv3)
-			c.writeError(StatusProtocolError, err)
-			return header{}, err
+			return header{}, c.protocolViolation(err)
 		}
 
 		if !c.client && !h.masked {
-			return header{}, errors.New("received unmasked frame from client")
+			return header{}, protocolViolationError{errors.New("received unmasked frame from client")}
 		}
 
 		switch h.opcode {
@@ -169,11 +573,17 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 				return header{}, fmt.Errorf("failed to handle control frame %v: %w", h.opcode, err)
 			}
 		case opContinuation, opText, opBinary:
+			if h.fin {
+				atomic.AddInt64(&c.stats.MessagesRead, 1)
+			}
 			return h, nil
 		default:
 			err := fmt.Errorf("received unknown opcode %v", h.opcode)
-			c.writeError(StatusProtocolError, err)
-			return header{}, err
+			if c.errorLog != nil {
+				c.errorLog.Printf("websocket: peer sent frame with reserved opcode %d (fin = %v, payload length = %v), closing with %v",
+					h.opcode, h.fin, h.payloadLength, StatusProtocolError)
+			}
+			return header{}, c.protocolViolation(err)
 		}
 	}
 }
@@ -204,6 +614,9 @@ func (c *Conn) readFrameHeader(ctx context.Context) (header, error) {
 	case c.readTimeout <- context.Background():
 	}
 
+	if c.onReadFrame != nil {
+		c.onReadFrame(h.trace())
+	}
 	return h, nil
 }
 
@@ -215,6 +628,7 @@ func (c *Conn) readFramePayload(ctx context.Context, p []byte) (int, error) {
 	}
 
 	n, err := io.ReadFull(c.br, p)
+	atomic.AddInt64(&c.stats.BytesRead, int64(n))
 	if err != nil {
 		select {
 		case <-c.closed:
@@ -237,16 +651,52 @@ func (c *Conn) readFramePayload(ctx context.Context, p []byte) (int, error) {
 	return n, err
 }
 
+// discardFramePayload reads and discards the payload of the frame h.
+func (c *Conn) discardFramePayload(ctx context.Context, h header) error {
+	var b [512]byte
+	for n := h.payloadLength; n > 0; {
+		p := b[:]
+		if n < int64(len(p)) {
+			p = p[:n]
+		}
+		_, err := c.readFramePayload(ctx, p)
+		if err != nil {
+			return err
+		}
+		n -= int64(len(p))
+	}
+	return nil
+}
+
+// protocolViolation closes the connection with StatusProtocolError because
+// the peer violated the protocol and returns err wrapped so that it
+// matches ErrProtocolViolation.
+func (c *Conn) protocolViolation(err error) error {
+	err = protocolViolationError{err}
+	c.writeError(StatusProtocolError, err)
+	return err
+}
+
 func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
+	// The payload of an invalid control frame is left unread. This cannot
+	// desync the stream as writeError closes the connection before we return
+	// and releases readMu so no further frame headers will be read.
 	if h.payloadLength < 0 || h.payloadLength > maxControlPayload {
 		err := fmt.Errorf("received control frame payload with invalid length: %d", h.payloadLength)
-		c.writeError(StatusProtocolError, err)
-		return err
+		c.controlFrameRejected(err)
+		return c.protocolViolation(err)
 	}
 
 	if !h.fin {
 		err := errors.New("received fragmented control frame")
-		c.writeError(StatusProtocolError, err)
+		c.controlFrameRejected(err)
+		return c.protocolViolation(err)
+	}
+
+	if !c.allowControlFrame() {
+		err := fmt.Errorf("received more than %v control frames in a second", c.controlLimit.Load())
+		c.controlFrameRejected(err)
+		c.writeError(StatusPolicyViolation, err)
 		return err
 	}
 
@@ -265,38 +715,94 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 
 	switch h.opcode {
 	case opPing:
+		if c.wroteCloseFrame() {
+			// Nothing may be written after our close frame.
+			return nil
+		}
 		return c.writeControl(ctx, opPong, b)
 	case opPong:
-		c.activePingsMu.Lock()
-		pong, ok := c.activePings[string(b)]
-		c.activePingsMu.Unlock()
-		if ok {
-			close(pong)
+		atomic.AddInt64(&c.stats.PongsReceived, 1)
+		if c.pongHandler != nil {
+			c.pongHandler(b)
 		}
+		c.handlePong(string(b))
 		return nil
 	}
 
 	defer func() {
+		c.closeMu.Lock()
 		c.readCloseFrameErr = err
+		c.closeMu.Unlock()
 	}()
 
 	ce, err := parseClosePayload(b)
 	if err != nil {
 		err = fmt.Errorf("received invalid close payload: %w", err)
-		c.writeError(StatusProtocolError, err)
-		return err
+		return c.protocolViolation(err)
 	}
 
-	err = fmt.Errorf("received close frame: %w", ce)
+	if c.closeHandler != nil {
+		c.closeHandler(ce)
+	}
+
+	err = fmt.Errorf("received close frame: %w", peerCloseError{ce})
 	c.setCloseErr(err)
-	c.writeClose(ce.Code, ce.Reason)
+	if c.writeClose(context.Background(), ce.Code, ce.Reason) == errAlreadyWroteClose {
+		// We are closing simultaneously. Whoever is writing our close frame
+		// will close the connection once it has been written.
+		return err
+	}
 	c.close(err)
 	return err
 }
 
-func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err error) {
+// handlePong signals the Ping waiting for the pong with payload p.
+// With coalesced pongs, every Ping sent before it is signalled too.
+func (c *Conn) handlePong(p string) {
+	c.activePingsMu.Lock()
+	defer c.activePingsMu.Unlock()
+
+	// The channels are reused so they must be signalled with
+	// activePingsMu held. See ping.
+	signal := func(pong chan<- struct{}) {
+		select {
+		case pong <- struct{}{}:
+		default:
+		}
+	}
+
+	pong, ok := c.activePings[p]
+	if !ok {
+		return
+	}
+	signal(pong)
+
+	if !c.coalescedPongs {
+		return
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return
+	}
+	for p2, pong := range c.activePings {
+		m, err := strconv.Atoi(p2)
+		if err == nil && m < n {
+			signal(pong)
+		}
+	}
+}
+
+// reader returns the reader for the next message.
+// cancel is called once the message has been read or on error.
+func (c *Conn) reader(ctx context.Context, cancel context.CancelFunc) (_ MessageType, _ io.Reader, err error) {
 	defer errd.Wrap(&err, "failed to get reader")
 
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
 	err = c.readMu.lock(ctx)
 	if err != nil {
 		return 0, nil, err
@@ -309,18 +815,43 @@ func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err erro
 		return 0, nil, err
 	}
 
-	h, err := c.readLoop(ctx)
-	if err != nil {
-		return 0, nil, err
+	var h header
+	for {
+		h, err = c.readLoop(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !c.wroteCloseFrame() {
+			break
+		}
+		// Once our close frame has been written, data frames are
+		// discarded until the peer's close frame arrives. See Close.
+		err = c.discardFramePayload(ctx, h)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
 	if h.opcode == opContinuation {
 		err := errors.New("received continuation frame without text or binary frame")
-		c.writeError(StatusProtocolError, err)
-		return 0, nil, err
+		return 0, nil, c.protocolViolation(err)
 	}
 
-	c.msgReader.reset(ctx, h)
+	if c.msgFilter != nil {
+		err = c.msgFilter(MessageHeader{
+			Type:        MessageType(h.opcode),
+			Compressed:  h.rsv1,
+			Fin:         h.fin,
+			FrameLength: h.payloadLength,
+		})
+		if err != nil {
+			err = fmt.Errorf("message rejected: %w", err)
+			c.writeError(StatusPolicyViolation, err)
+			return 0, nil, err
+		}
+	}
+
+	c.msgReader.reset(ctx, cancel, h)
 
 	return MessageType(h.opcode), c.msgReader, nil
 }
@@ -329,6 +860,7 @@ type msgReader struct {
 	c *Conn
 
 	ctx         context.Context
+	cancel      context.CancelFunc
 	flate       bool
 	flateReader io.Reader
 	flateBufio  *bufio.Reader
@@ -336,33 +868,150 @@ type msgReader struct {
 	limitReader *limitReader
 	dict        slidingWindow
 
+	validateUTF8 bool
+	utf8         utf8Validator
+
+	// raw is set when the current message is being read with ReadRaw.
+	raw           bool
 	fin           bool
 	payloadLength int64
 	maskKey       uint32
+	size          int64
+	// buffered is the length of the message if it was entirely buffered
+	// when begun or -1. See bufferedLen.
+	buffered int64
+
+	// infoMu guards info, eof and writes to flate, fin and payloadLength
+	// so that they can be accessed without readMu.
+	infoMu sync.Mutex
+	info   FrameInfo
+	// eof is set once the message has been read to completion.
+	// As mr.ctx is then done, Read must not lock readMu with it.
+	eof bool
 
 	// readerFunc(mr.Read) to avoid continuous allocations.
 	readFunc readerFunc
 }
 
-func (mr *msgReader) reset(ctx context.Context, h header) {
+func (mr *msgReader) reset(ctx context.Context, cancel context.CancelFunc, h header) {
 	mr.ctx = ctx
-	mr.flate = h.rsv1
+	mr.cancel = cancel
+	mr.raw = false
+	mr.size = 0
 	mr.limitReader.reset(mr.readFunc)
+	mr.validateUTF8 = mr.c.validateUTF8 && h.opcode == opText
+	mr.utf8.reset()
+
+	mr.infoMu.Lock()
+	mr.flate = h.rsv1
+	mr.info = FrameInfo{
+		Compressed: h.rsv1,
+	}
+	mr.eof = false
+	mr.infoMu.Unlock()
 
 	if mr.flate {
 		mr.resetFlate()
 	}
 
 	mr.setFrame(h)
+	mr.setBuffered()
 }
 
 func (mr *msgReader) setFrame(h header) {
+	mr.maskKey = h.maskKey
+
+	mr.infoMu.Lock()
 	mr.fin = h.fin
 	mr.payloadLength = h.payloadLength
-	mr.maskKey = h.maskKey
+	mr.info.Frames++
+	mr.info.Length += h.payloadLength
+	mr.infoMu.Unlock()
+}
+
+// FrameInfo describes the frames of a data message as received on the wire.
+type FrameInfo struct {
+	// Frames is the number of frames the message was fragmented into.
+	Frames int
+	// Compressed is whether the message was compressed with permessage-deflate.
+	Compressed bool
+	// Length is the total payload length of the frames.
+	// For compressed messages, it is the compressed length.
+	Length int64
+}
+
+// LastFrameInfo returns the FrameInfo of the most recent message
+// returned by Reader or Read.
+//
+// While a message is still being read, it only covers the frames seen so far.
+func (c *Conn) LastFrameInfo() FrameInfo {
+	c.msgReader.infoMu.Lock()
+	defer c.msgReader.infoMu.Unlock()
+	return c.msgReader.info
+}
+
+// Remaining returns the number of bytes left to read in the message or -1
+// if it is not yet known. The total is only known once the final frame of an
+// uncompressed message has been reached.
+//
+// The io.Reader returned from Reader implements it. Use a type assertion
+// to access it:
+//
+//	rr, ok := r.(interface{ Remaining() int64 })
+func (mr *msgReader) Remaining() int64 {
+	mr.infoMu.Lock()
+	defer mr.infoMu.Unlock()
+
+	if mr.flate || !mr.fin {
+		return -1
+	}
+	return mr.payloadLength
+}
+
+// FrameRemaining returns the number of payload bytes of the current frame
+// that have not been read from the connection yet and whether the frame is
+// the final frame of the message. For compressed messages, the bytes are
+// compressed and may already have been read ahead of decompression.
+//
+// The io.Reader returned from Reader implements it. Use a type assertion
+// to access it:
+//
+//	fr, ok := r.(interface{ FrameRemaining() (int64, bool) })
+func (mr *msgReader) FrameRemaining() (n int64, fin bool) {
+	mr.infoMu.Lock()
+	defer mr.infoMu.Unlock()
+
+	return mr.payloadLength, mr.fin
+}
+
+// bufferedLen returns the length of the message if it is a single
+// uncompressed frame that is within the read limit and whose payload
+// had already been entirely buffered when the message was begun.
+func (mr *msgReader) bufferedLen() (int, bool) {
+	return int(mr.buffered), mr.buffered >= 0
+}
+
+// setBuffered records the result for bufferedLen.
+// It must be called with readMu held.
+func (mr *msgReader) setBuffered() {
+	mr.buffered = -1
+	if mr.flate || !mr.fin || mr.payloadLength >= mr.limitReader.n {
+		return
+	}
+	if int64(mr.c.br.Buffered()) < mr.payloadLength {
+		return
+	}
+	mr.buffered = mr.payloadLength
 }
 
 func (mr *msgReader) Read(p []byte) (n int, err error) {
+	mr.infoMu.Lock()
+	eof := mr.eof
+	mr.infoMu.Unlock()
+	if eof {
+		return 0, io.EOF
+	}
+
 	err = mr.c.readMu.lock(mr.ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read: %w", err)
@@ -370,17 +1019,35 @@ func (mr *msgReader) Read(p []byte) (n int, err error) {
 	defer mr.c.readMu.unlock()
 
 	n, err = mr.limitReader.Read(p)
-	if mr.flate && mr.flateContextTakeover() {
-		p = p[:n]
-		mr.dict.write(p)
+	mr.size += int64(n)
+	if mr.flate {
+		atomic.AddInt64(&mr.c.stats.UncompressedBytesRead, int64(n))
+		if mr.flateContextTakeover() {
+			mr.dict.write(p[:n])
+		}
 	}
-	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && mr.fin && mr.flate {
+	eof = errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && mr.fin && mr.flate
+	if mr.validateUTF8 && (!mr.utf8.write(p[:n]) || eof && !mr.utf8.done()) {
+		err = errors.New("received invalid UTF-8 in text message")
+		mr.c.writeError(StatusInvalidFramePayloadData, err)
+		mr.cancel()
+		return n, err
+	}
+	if eof {
+		if mr.c.readSizes != nil {
+			mr.c.readSizes.observe(mr.size)
+		}
 		mr.putFlateReader()
+		mr.infoMu.Lock()
+		mr.eof = true
+		mr.infoMu.Unlock()
+		mr.cancel()
 		return n, io.EOF
 	}
 	if err != nil {
 		err = fmt.Errorf("failed to read: %w", err)
 		mr.c.close(err)
+		mr.cancel()
 	}
 	return n, err
 }
@@ -401,8 +1068,7 @@ func (mr *msgReader) read(p []byte) (int, error) {
 			}
 			if h.opcode != opContinuation {
 				err := errors.New("received new data message without finishing the previous message")
-				mr.c.writeError(StatusProtocolError, err)
-				return 0, err
+				return 0, mr.c.protocolViolation(err)
 			}
 			mr.setFrame(h)
 
@@ -414,11 +1080,16 @@ func (mr *msgReader) read(p []byte) (int, error) {
 		}
 
 		n, err := mr.c.readFramePayload(mr.ctx, p)
+		if mr.flate {
+			atomic.AddInt64(&mr.c.stats.CompressedBytesRead, int64(n))
+		}
 		if err != nil {
 			return n, err
 		}
 
+		mr.infoMu.Lock()
 		mr.payloadLength -= int64(n)
+		mr.infoMu.Unlock()
 
 		if !mr.c.client {
 			mr.maskKey = mask(mr.maskKey, p)
@@ -451,7 +1122,8 @@ func (lr *limitReader) reset(r io.Reader) {
 
 func (lr *limitReader) Read(p []byte) (int, error) {
 	if lr.n <= 0 {
-		err := fmt.Errorf("read limited at %v bytes", lr.limit.Load())
+		// The limit includes the extra byte read for the fin frame.
+		err := ReadLimitError{Limit: lr.limit.Load() - 1}
 		lr.c.writeError(StatusMessageTooBig, err)
 		return 0, err
 	}
@@ -464,8 +1136,119 @@ func (lr *limitReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// memReservation tracks the memory reserved from the connection's
+// MemoryLimiter for a single read. It reserves nothing without a limiter.
+type memReservation struct {
+	c *Conn
+	n int64
+}
+
+// grow reserves n more bytes. It must be called before they are allocated.
+// If the budget is exhausted, the connection is closed with StatusTryAgainLater.
+func (res *memReservation) grow(n int) error {
+	ml := res.c.memLimiter
+	if ml == nil {
+		return nil
+	}
+	if !ml.reserve(int64(n)) {
+		err := fmt.Errorf("memory limit of %v bytes exhausted", ml.limit)
+		res.c.writeError(StatusTryAgainLater, err)
+		return err
+	}
+	res.n += int64(n)
+	return nil
+}
+
+// release returns everything reserved so far to the limiter.
+// It may be called more than once.
+func (res *memReservation) release() {
+	if res.n > 0 {
+		res.c.memLimiter.release(res.n)
+		res.n = 0
+	}
+}
+
+// readAll is like ioutil.ReadAll but appends to b and reserves memory
+// with res before growing it.
+func readAll(r io.Reader, res *memReservation, b []byte) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			n := cap(b)
+			if n < bytes.MinRead {
+				n = bytes.MinRead
+			}
+			err := res.grow(n)
+			if err != nil {
+				return b, err
+			}
+			nb := make([]byte, len(b), cap(b)+n)
+			copy(nb, b)
+			b = nb
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return b, err
+		}
+	}
+}
+
 type readerFunc func(p []byte) (int, error)
 
 func (f readerFunc) Read(p []byte) (int, error) {
 	return f(p)
 }
+
+// utf8Validator validates UTF-8 incrementally as a message is read.
+// A rune may be split across reads and frames so an incomplete rune
+// at the end of the bytes read so far is held until it is completed.
+type utf8Validator struct {
+	partial [utf8.UTFMax]byte
+	n       int
+}
+
+func (v *utf8Validator) reset() {
+	v.n = 0
+}
+
+// write reports whether p continues the bytes written so far as valid UTF-8.
+func (v *utf8Validator) write(p []byte) bool {
+	if v.n > 0 {
+		for len(p) > 0 && !utf8.FullRune(v.partial[:v.n]) {
+			v.partial[v.n] = p[0]
+			v.n++
+			p = p[1:]
+		}
+		if !utf8.FullRune(v.partial[:v.n]) {
+			return true
+		}
+		if !utf8.Valid(v.partial[:v.n]) {
+			return false
+		}
+		v.n = 0
+	}
+
+	// Hold back a rune that is incomplete at the end of p.
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.n = copy(v.partial[:], p[end:])
+	return true
+}
+
+// done reports whether the bytes written did not end with an incomplete rune.
+func (v *utf8Validator) done() bool {
+	return v.n == 0
+}
@@ -0,0 +1,115 @@
+// +build !js
+
+package websocket
+
+import (
+	"strconv"
+	"testing"
+
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestConn_handlePong(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		coalescedPongs bool
+		pong           string
+		signalled      map[string]bool
+	}{
+		{
+			name: "strict",
+			pong: "2",
+			signalled: map[string]bool{
+				"1": false,
+				"2": true,
+				"3": false,
+			},
+		},
+		{
+			name:           "coalesced",
+			coalescedPongs: true,
+			pong:           "2",
+			signalled: map[string]bool{
+				"1": true,
+				"2": true,
+				"3": false,
+			},
+		},
+		{
+			name:           "unknown",
+			coalescedPongs: true,
+			pong:           "4",
+			signalled: map[string]bool{
+				"1": false,
+				"2": false,
+				"3": false,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Conn{
+				activePings:    make(map[string]chan<- struct{}),
+				coalescedPongs: tc.coalescedPongs,
+			}
+			pongs := make(map[string]chan struct{})
+			for p := range tc.signalled {
+				pongs[p] = make(chan struct{}, 1)
+				c.activePings[p] = pongs[p]
+			}
+
+			c.handlePong(tc.pong)
+
+			for p, exp := range tc.signalled {
+				assert.Equal(t, "ping "+p+" signalled", exp, len(pongs[p]) == 1)
+			}
+		})
+	}
+}
+
+func Test_utf8Validator(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		in    string
+		valid bool
+	}{
+		{name: "ascii", in: "hello", valid: true},
+		{name: "multibyte", in: "héllo, 世界 🌍", valid: true},
+		{name: "replacementChar", in: "\uFFFD", valid: true},
+		{name: "invalidByte", in: "hello\xff", valid: false},
+		{name: "overlong", in: "\xc0\xaf", valid: false},
+		{name: "surrogate", in: "\xed\xa0\x80", valid: false},
+		{name: "badContinuation", in: "\xe4\xb8x", valid: false},
+		{name: "truncated", in: "hello\xf0\x9f\x8c", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Every way of splitting the input in two must give the same result.
+			for i := 0; i <= len(tc.in); i++ {
+				var v utf8Validator
+				valid := v.write([]byte(tc.in[:i])) && v.write([]byte(tc.in[i:])) && v.done()
+				assert.Equal(t, "valid split at "+strconv.Itoa(i), tc.valid, valid)
+			}
+
+			// As well as writing it a byte at a time.
+			var v utf8Validator
+			valid := true
+			for i := 0; i < len(tc.in) && valid; i++ {
+				valid = v.write([]byte{tc.in[i]})
+			}
+			assert.Equal(t, "valid bytewise", tc.valid, valid && v.done())
+		})
+	}
+}
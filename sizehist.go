@@ -0,0 +1,54 @@
+package websocket
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// SizeHistogram counts messages by their size.
+// It may be shared between connections.
+//
+// Use it to choose read limits and buffer sizes based on the messages
+// your connections actually see.
+type SizeHistogram struct {
+	bounds []int64
+	counts []int64
+}
+
+// NewSizeHistogram returns a SizeHistogram with buckets split at the given
+// upper bounds. The bounds are inclusive and sorted if necessary.
+// An extra bucket counts messages larger than every bound.
+func NewSizeHistogram(bounds ...int64) *SizeHistogram {
+	bounds = append([]int64(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i] < bounds[j]
+	})
+	return &SizeHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Bounds returns the upper bounds of the buckets.
+func (h *SizeHistogram) Bounds() []int64 {
+	return append([]int64(nil), h.bounds...)
+}
+
+// Counts returns the number of messages in each bucket.
+// counts[i] is the number of messages no larger than Bounds()[i] and
+// larger than the previous bound. The last count is for messages
+// larger than every bound.
+func (h *SizeHistogram) Counts() []int64 {
+	counts := make([]int64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return counts
+}
+
+func (h *SizeHistogram) observe(n int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool {
+		return n <= h.bounds[i]
+	})
+	atomic.AddInt64(&h.counts[i], 1)
+}
@@ -5,15 +5,17 @@ package websocket
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/flate"
 
+	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/errd"
 )
 
@@ -24,31 +26,341 @@ import (
 //
 // Only one writer can be open at a time, multiple calls will block until the previous writer
 // is closed.
+//
+// If the context is done before the writer is closed, such as when the goroutine
+// writing the message returns early, the message cannot be completed and the
+// connection is closed so that later writes fail instead of blocking forever.
 func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
 	w, err := c.writer(ctx, typ)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get writer: %w", err)
 	}
+	c.msgWriterState.watch()
 	return w, nil
 }
 
+// TryWriter is like Writer but instead of waiting for the previous writer
+// to be closed, it returns false immediately if there is one. It allows
+// shedding load instead of queueing writes behind a slow writer.
+//
+// The context bounds the returned writer as with Writer.
+func (c *Conn) TryWriter(ctx context.Context, typ MessageType) (io.WriteCloser, bool, error) {
+	w, ok, err := c.tryWriter(ctx, typ)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get writer: %w", err)
+	}
+	if ok {
+		c.msgWriterState.watch()
+	}
+	return w, ok, nil
+}
+
 // Write writes a message to the connection.
 //
 // See the Writer method if you want to stream a message.
 //
 // If compression is disabled or the threshold is not met, then it
 // will write the message in a single frame.
+//
+// If a high water mark is set with SetWriteBufferHighWater and queueing
+// p would exceed it, Write returns ErrBackpressure without writing p
+// or, if enabled with SetWriteBufferBlocking, waits until p fits.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
-	_, err := c.write(ctx, typ, p)
+	err := c.reserveWriteBacklog(ctx, len(p))
+	if err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	defer c.releaseWriteBacklog(len(p))
+
+	_, err = c.write(ctx, typ, p)
+	if err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	return nil
+}
+
+// WriteFrom is a convenience method around Writer to write a message
+// with the contents of r until io.EOF. It returns the number of bytes
+// read from r.
+//
+// The context bounds writing every chunk of the message as with Writer.
+// As a message cannot be abandoned once started, the connection is closed
+// with StatusInternalError if reading from r fails.
+func (c *Conn) WriteFrom(ctx context.Context, typ MessageType, r io.Reader) (int64, error) {
+	w, err := c.Writer(ctx, typ)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		err = fmt.Errorf("failed to write msg from reader: %w", err)
+		c.writeError(StatusInternalError, err)
+		return n, err
+	}
+
+	return n, w.Close()
+}
+
+// ErrBackpressure is returned by Write when the message would push the
+// bytes waiting to be written past the high water mark set with
+// SetWriteBufferHighWater. Use errors.Is to check for it.
+//
+// The message is not written and the connection remains usable.
+var ErrBackpressure = errors.New("write backlog over high water mark")
+
+// SetWriteBufferHighWater sets the maximum number of bytes that concurrent
+// Write calls may have queued or in flight at once.
+//
+// Write blocks while the peer is slow to read and while other writes are in
+// progress. With a high water mark set, a Write that would exceed it fails
+// immediately with ErrBackpressure instead so that the caller can drop or
+// coalesce messages rather than pile up goroutines. See SetWriteBufferBlocking
+// to wait instead. A single message larger than n is still written if nothing
+// else is waiting.
+//
+// Writer and the other write methods are not counted.
+//
+// By default, or if n <= 0, there is no limit.
+func (c *Conn) SetWriteBufferHighWater(n int) {
+	c.writeBacklogMu.Lock()
+	c.writeHighWater = n
+	c.writeBacklogMu.Unlock()
+}
+
+// SetWriteBufferBlocking sets whether a Write that would exceed the high water
+// mark set with SetWriteBufferHighWater waits for the writes ahead of it to
+// complete instead of failing with ErrBackpressure. The context passed to Write
+// bounds the wait. This makes Write behave like a send on a bounded queue.
+//
+// By default, Write fails with ErrBackpressure.
+func (c *Conn) SetWriteBufferBlocking(block bool) {
+	c.writeBacklogMu.Lock()
+	c.writeBacklogBlock = block
+	c.writeBacklogMu.Unlock()
+}
+
+func (c *Conn) reserveWriteBacklog(ctx context.Context, n int) error {
+	for {
+		c.writeBacklogMu.Lock()
+		if c.writeHighWater <= 0 || c.writeBacklog == 0 || c.writeBacklog+n <= c.writeHighWater {
+			c.writeBacklog += n
+			c.writeBacklogMu.Unlock()
+			return nil
+		}
+		if !c.writeBacklogBlock {
+			c.writeBacklogMu.Unlock()
+			return ErrBackpressure
+		}
+		if c.writeBacklogFreed == nil {
+			c.writeBacklogFreed = make(chan struct{})
+		}
+		freed := c.writeBacklogFreed
+		c.writeBacklogMu.Unlock()
+
+		select {
+		case <-c.closed:
+			return c.closeErr
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+func (c *Conn) releaseWriteBacklog(n int) {
+	c.writeBacklogMu.Lock()
+	c.writeBacklog -= n
+	if c.writeBacklogFreed != nil {
+		close(c.writeBacklogFreed)
+		c.writeBacklogFreed = nil
+	}
+	c.writeBacklogMu.Unlock()
+}
+
+// WriteAndClose writes a final message and then performs the close handshake
+// with the given status code and reason.
+//
+// The message and the close frame are flushed together so that they will
+// usually arrive at the peer in a single TCP segment. This is useful for
+// one shot interactions where the number of packets on close matters.
+// No other message can be written in between.
+//
+// The context bounds writing the message, the close frame and waiting for
+// the peer's close frame. Without a deadline, the peer's close frame is
+// waited for up to 5s as with Close.
+//
+// See Write and Close.
+func (c *Conn) WriteAndClose(ctx context.Context, typ MessageType, p []byte, code StatusCode, reason string) error {
+	_, err := c.writer(ctx, typ)
 	if err != nil {
 		return fmt.Errorf("failed to write msg: %w", err)
 	}
+	mw := c.msgWriterState
+	unlock := func() {
+		mw.cancel()
+		mw.mu.unlock()
+	}
+
+	_, err = mw.writeMsg(p, true)
+	if err != nil {
+		unlock()
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	return c.closeHandshake(ctx, code, func() error {
+		// Held until the close frame has been written so that no other
+		// message can be written between it and the final message.
+		defer unlock()
+
+		err := c.writeClose(mw.ctx, code, reason)
+		if err != nil {
+			// The close frame was to flush the message along with it.
+			c.flush(mw.ctx)
+		}
+		return err
+	})
+}
+
+// WriteMessages writes each payload as its own message of the given type.
+//
+// The messages are written while holding the writer once and flushed together
+// at the end. This amortizes locking and syscalls when writing many small
+// messages. Every message is compressed as it would be with Write.
+//
+// See Write.
+func (c *Conn) WriteMessages(ctx context.Context, typ MessageType, payloads [][]byte) error {
+	err := c.writeMessages(ctx, typ, payloads)
+	if err != nil {
+		return fmt.Errorf("failed to write msgs: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) writeMessages(ctx context.Context, typ MessageType, payloads [][]byte) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	_, err := c.writer(ctx, typ)
+	if err != nil {
+		return err
+	}
+	mw := c.msgWriterState
+	defer mw.mu.unlock()
+	defer mw.cancel()
+
+	for i, p := range payloads {
+		// Flushing the last message flushes the others with it.
+		_, err = mw.writeMsg(p, i < len(payloads)-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFragmented writes a message split into exactly the given fragments.
+//
+// The first fragment is written as a frame of type typ and the rest as
+// continuation frames with the last one marking the end of the message.
+// Compression is never applied so that every frame carries its fragment as is.
+//
+// This is useful to test how a peer handles specific fragmentation patterns.
+// Most applications should use Write or Writer instead.
+func (c *Conn) WriteFragmented(ctx context.Context, typ MessageType, fragments [][]byte) error {
+	err := c.writeFragmented(ctx, typ, fragments)
+	if err != nil {
+		return fmt.Errorf("failed to write fragmented msg: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) writeFragmented(ctx context.Context, typ MessageType, fragments [][]byte) error {
+	_, err := c.writer(ctx, typ)
+	if err != nil {
+		return err
+	}
+	mw := c.msgWriterState
+	defer mw.mu.unlock()
+	defer mw.cancel()
+
+	if len(fragments) == 0 {
+		fragments = [][]byte{nil}
+	}
+	for i, p := range fragments {
+		_, err = c.writeFrame(mw.ctx, i == len(fragments)-1, false, mw.opcode, p)
+		if err != nil {
+			return err
+		}
+		mw.size += int64(len(p))
+		mw.opcode = opContinuation
+	}
+	if c.writeSizes != nil {
+		c.writeSizes.observe(mw.size)
+	}
 	return nil
 }
 
+// WriteRaw writes a single data frame with the exact framing described by h.
+// It is the counterpart to ReadRaw for proxying frames between connections.
+//
+// The frame that begins a message must have a Type. The remaining frames of the
+// message must have a Type of 0 and the last must have Fin set. No other message
+// can be written until the last frame has been written.
+//
+// Compressed frames can only be written if no context takeover was negotiated
+// for our side of the connection. Otherwise the sliding window the peer inflates
+// with would no longer match the one used to compress messages written with
+// Write and Writer.
+//
+// WriteRaw must not be called concurrently with itself.
+func (c *Conn) WriteRaw(ctx context.Context, h FrameHeader, p []byte) error {
+	err := c.writeRaw(ctx, h, p)
+	if err != nil {
+		return fmt.Errorf("failed to write raw frame: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) writeRaw(ctx context.Context, h FrameHeader, p []byte) error {
+	if c.role == RoleReadOnly {
+		return errors.New("connection is read only")
+	}
+	if h.Type != 0 && !h.Type.valid() {
+		return fmt.Errorf("unexpected message type: %v", h.Type)
+	}
+	if h.Compressed && !c.flate() {
+		return errors.New("cannot write compressed frame as compression was not negotiated")
+	}
+	if h.Compressed && c.msgWriterState.flateContextTakeover() {
+		return errors.New("cannot write compressed frame with context takeover as the peer's window would no longer match ours")
+	}
+
+	if h.Type != 0 {
+		if c.rawMsgOpen {
+			return errors.New("previous message not written to completion")
+		}
+		err := c.msgWriterState.mu.lock(ctx)
+		if err != nil {
+			return err
+		}
+		c.rawMsgOpen = true
+	} else if !c.rawMsgOpen {
+		return errors.New("continuation frame without a message to continue")
+	}
+
+	_, err := c.writeFrame(ctx, h.Fin, h.Compressed, opcode(h.Type), p)
+	if h.Fin || err != nil {
+		c.rawMsgOpen = false
+		c.msgWriterState.mu.unlock()
+	}
+	return err
+}
+
 type msgWriter struct {
 	mw     *msgWriterState
 	closed bool
+	frames int
 }
 
 func (mw *msgWriter) Write(p []byte) (int, error) {
@@ -58,12 +370,93 @@ func (mw *msgWriter) Write(p []byte) (int, error) {
 	return mw.mw.Write(p)
 }
 
+// readFromBufPool holds the buffers ReadFrom reads chunks into.
+var readFromBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32<<10)
+		return &b
+	},
+}
+
+// ReadFrom implements io.ReaderFrom so that io.Copy streams r into the
+// message without the caller allocating a buffer. Each chunk read from r
+// is written as with Write so the writer's context still bounds every chunk.
+//
+// The writer must still be closed to write the final frame.
+func (mw *msgWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if mw.closed {
+		return 0, errors.New("cannot use closed writer")
+	}
+
+	bp := readFromBufPool.Get().(*[]byte)
+	defer readFromBufPool.Put(bp)
+	b := *bp
+
+	for {
+		nr, rerr := r.Read(b)
+		if nr > 0 {
+			nw, err := mw.mw.Write(b[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
 func (mw *msgWriter) Close() error {
 	if mw.closed {
 		return errors.New("cannot use closed writer")
 	}
 	mw.closed = true
-	return mw.mw.Close()
+	// Read before Close as another writer may take over the state once it returns.
+	mw.frames = mw.mw.frames
+	err := mw.mw.Close()
+	if err == nil {
+		// The fin frame.
+		mw.frames++
+	}
+	return err
+}
+
+// Flush writes the frames buffered so far to the connection without
+// finishing the message.
+//
+// Every Write is written as its own frame but frames are only flushed
+// to the connection once the final frame is written by Close. Use Flush
+// when the peer must receive each frame as soon as it is written.
+// With compression, the last few bytes of compressed data are held back
+// until the next Write or Close.
+//
+// The io.WriteCloser returned from Writer implements it. Use a type assertion
+// to access it:
+//
+//	f, ok := w.(interface{ Flush() error })
+func (mw *msgWriter) Flush() error {
+	if mw.closed {
+		return errors.New("cannot use closed writer")
+	}
+	return mw.mw.flush()
+}
+
+// FramesWritten returns the number of frames the message was written in.
+// It is only final once the writer has been closed.
+//
+// The io.WriteCloser returned from Writer implements it. Use a type assertion
+// to access it:
+//
+//	fw, ok := w.(interface{ FramesWritten() int })
+func (mw *msgWriter) FramesWritten() int {
+	if mw.closed {
+		return mw.frames
+	}
+	return mw.mw.frames
 }
 
 type msgWriterState struct {
@@ -73,11 +466,17 @@ type msgWriterState struct {
 	writeMu *mu
 
 	ctx    context.Context
+	cancel context.CancelFunc
 	opcode opcode
 	flate  bool
+	frames int
+	size   int64
 
 	trimWriter *trimLastFourBytesWriter
 	dict       slidingWindow
+
+	// watched is set when timeoutLoop bounds the writer. See watch.
+	watched bool
 }
 
 func newMsgWriterState(c *Conn) *msgWriterState {
@@ -107,9 +506,25 @@ func (mw *msgWriterState) flateContextTakeover() bool {
 	return !mw.c.copts.serverNoContextTakeover
 }
 
+func (c *Conn) checkWriter(typ MessageType) error {
+	if c.role == RoleReadOnly {
+		return errors.New("connection is read only")
+	}
+	if !typ.valid() {
+		return fmt.Errorf("unexpected message type: %v", typ)
+	}
+	return nil
+}
+
 func (c *Conn) writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
-	err := c.msgWriterState.reset(ctx, typ)
+	err := c.checkWriter(typ)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withDefaultTimeout(ctx, &c.defaultWriteTimeout, &c.writeDeadline)
+	err = c.msgWriterState.reset(ctx, cancel, typ)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 	return &msgWriter{
@@ -118,39 +533,129 @@ func (c *Conn) writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 	}, nil
 }
 
+func (c *Conn) tryWriter(ctx context.Context, typ MessageType) (io.WriteCloser, bool, error) {
+	err := c.checkWriter(typ)
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err := c.msgWriterState.mu.tryLock()
+	if !ok {
+		return nil, false, err
+	}
+	ctx, cancel := withDefaultTimeout(ctx, &c.defaultWriteTimeout, &c.writeDeadline)
+	c.msgWriterState.init(ctx, cancel, typ)
+	return &msgWriter{
+		mw:     c.msgWriterState,
+		closed: false,
+	}, true, nil
+}
+
+// write writes p as a single message.
 func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error) {
-	mw, err := c.writer(ctx, typ)
+	_, err := c.writer(ctx, typ)
 	if err != nil {
 		return 0, err
 	}
+	mw := c.msgWriterState
+	defer mw.mu.unlock()
+	defer mw.cancel()
 
-	if !c.flate() {
-		defer c.msgWriterState.mu.unlock()
-		return c.writeFrame(ctx, true, false, c.msgWriterState.opcode, p)
+	return mw.writeMsg(p, false)
+}
+
+// writeMsg writes p as a single frame message. If cork is set, the frame is
+// left buffered for the next frame written to flush. The lock must be held.
+func (mw *msgWriterState) writeMsg(p []byte, cork bool) (n int, err error) {
+	c := mw.c
+	if c.flate() && len(p) >= c.flateThreshold {
+		n, err = mw.writeCompressed(p, cork)
+	} else {
+		n, err = c.writeFrameCorked(mw.ctx, cork, true, false, mw.opcode, p)
 	}
+	if err == nil && c.writeSizes != nil {
+		c.writeSizes.observe(int64(n))
+	}
+	return n, err
+}
 
-	n, err := mw.Write(p)
+// writeCompressed writes p as a single frame. p is compressed into a scratch
+// buffer first and only sent compressed if that saves more than
+// flateMinSavings bytes. Otherwise p is sent as is so that incompressible
+// payloads do not grow and the peer does not have to inflate them.
+func (mw *msgWriterState) writeCompressed(p []byte, cork bool) (int, error) {
+	// Held so that close does not release the window while it is in use.
+	err := mw.writeMu.lock(mw.ctx)
 	if err != nil {
-		return n, err
+		return 0, err
 	}
+	defer mw.writeMu.unlock()
 
-	err = mw.Close()
-	return n, err
+	var dict []byte
+	if mw.flateContextTakeover() {
+		mw.dict.init(8192)
+		dict = mw.dict.buf
+	}
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	err = flate.StatelessDeflate(&trimLastFourBytesWriter{w: b}, p, false, dict)
+	if err != nil {
+		err = fmt.Errorf("failed to compress: %w", err)
+		mw.c.close(err)
+		return 0, err
+	}
+
+	if b.Len()+mw.c.flateMinSavings >= len(p) {
+		return mw.c.writeFrameCorked(mw.ctx, cork, true, false, mw.opcode, p)
+	}
+
+	n, err := mw.c.writeFrameCorked(mw.ctx, cork, true, true, mw.opcode, b.Bytes())
+	atomic.AddInt64(&mw.c.stats.CompressedBytesWritten, int64(n))
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&mw.c.stats.UncompressedBytesWritten, int64(len(p)))
+	if dict != nil {
+		mw.dict.write(p)
+	}
+	return len(p), nil
 }
 
-func (mw *msgWriterState) reset(ctx context.Context, typ MessageType) error {
+// watch hands the context of the writer returned to the caller to
+// timeoutLoop which closes the connection if it is done before the
+// writer is closed.
+func (mw *msgWriterState) watch() {
+	if mw.ctx.Done() == nil {
+		return
+	}
+	select {
+	case <-mw.c.closed:
+	case mw.c.writerTimeout <- mw.ctx:
+		mw.watched = true
+	}
+}
+
+func (mw *msgWriterState) reset(ctx context.Context, cancel context.CancelFunc, typ MessageType) error {
 	err := mw.mu.lock(ctx)
 	if err != nil {
 		return err
 	}
+	mw.init(ctx, cancel, typ)
+	return nil
+}
 
+// init prepares the state for a new message. The lock must be held.
+func (mw *msgWriterState) init(ctx context.Context, cancel context.CancelFunc, typ MessageType) {
 	mw.ctx = ctx
+	mw.cancel = cancel
 	mw.opcode = opcode(typ)
 	mw.flate = false
+	mw.watched = false
+	mw.frames = 0
+	mw.size = 0
 
 	mw.trimWriter.reset()
-
-	return nil
 }
 
 // Write writes the given bytes to the WebSocket connection.
@@ -168,6 +673,8 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 		}
 	}()
 
+	mw.size += int64(len(p))
+
 	if mw.c.flate() {
 		// Only enables flate if the length crosses the
 		// threshold on the first frame
@@ -181,6 +688,7 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 		if err != nil {
 			return 0, err
 		}
+		atomic.AddInt64(&mw.c.stats.UncompressedBytesWritten, int64(len(p)))
 		mw.dict.write(p)
 		return len(p), nil
 	}
@@ -190,9 +698,13 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 
 func (mw *msgWriterState) write(p []byte) (int, error) {
 	n, err := mw.c.writeFrame(mw.ctx, false, mw.flate, mw.opcode, p)
+	if mw.flate {
+		atomic.AddInt64(&mw.c.stats.CompressedBytesWritten, int64(n))
+	}
 	if err != nil {
 		return n, fmt.Errorf("failed to write data frame: %w", err)
 	}
+	mw.frames++
 	mw.opcode = opContinuation
 	return n, nil
 }
@@ -207,18 +719,45 @@ func (mw *msgWriterState) Close() (err error) {
 	}
 	defer mw.writeMu.unlock()
 
+	if mw.watched {
+		// From here the fin frame is bounded by writeFrame.
+		select {
+		case <-mw.c.closed:
+			return mw.c.closeErr
+		case mw.c.writerTimeout <- context.Background():
+		}
+		mw.watched = false
+	}
+
 	_, err = mw.c.writeFrame(mw.ctx, true, mw.flate, mw.opcode, nil)
 	if err != nil {
 		return fmt.Errorf("failed to write fin frame: %w", err)
 	}
+	mw.frames++
+	if mw.c.writeSizes != nil {
+		mw.c.writeSizes.observe(mw.size)
+	}
 
 	if mw.flate && !mw.flateContextTakeover() {
 		mw.dict.close()
 	}
+	mw.cancel()
 	mw.mu.unlock()
 	return nil
 }
 
+func (mw *msgWriterState) flush() (err error) {
+	defer errd.Wrap(&err, "failed to flush writer")
+
+	err = mw.writeMu.lock(mw.ctx)
+	if err != nil {
+		return err
+	}
+	defer mw.writeMu.unlock()
+
+	return mw.c.flush(mw.ctx)
+}
+
 func (mw *msgWriterState) close() {
 	if mw.c.client {
 		mw.c.writeFrameMu.forceLock()
@@ -230,7 +769,7 @@ func (mw *msgWriterState) close() {
 }
 
 func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.controlWriteTimeout.Load()))
 	defer cancel()
 
 	_, err := c.writeFrame(ctx, true, false, opcode, p)
@@ -240,8 +779,44 @@ func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error
 	return nil
 }
 
+// flush flushes the frames buffered in bw to the connection.
+func (c *Conn) flush(ctx context.Context) error {
+	err := c.writeFrameMu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.writeFrameMu.unlock()
+
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case c.writeTimeout <- ctx:
+	}
+
+	err = c.bw.Flush()
+	if err != nil {
+		err = fmt.Errorf("failed to flush: %w", err)
+		c.close(err)
+		return err
+	}
+
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case c.writeTimeout <- context.Background():
+	}
+	return nil
+}
+
 // frame handles all writes to the connection.
-func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (_ int, err error) {
+func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (int, error) {
+	return c.writeFrameCorked(ctx, false, fin, flate, opcode, p)
+}
+
+// writeFrameCorked is like writeFrame but if cork is set, a final frame is
+// not flushed. The flush is left to the next frame written which allows
+// a final message to share a segment with the frame after it.
+func (c *Conn) writeFrameCorked(ctx context.Context, cork bool, fin bool, flate bool, opcode opcode, p []byte) (_ int, err error) {
 	err = c.writeFrameMu.lock(ctx)
 	if err != nil {
 		return 0, err
@@ -290,7 +865,7 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 
 	if c.client {
 		c.writeHeader.masked = true
-		_, err = io.ReadFull(rand.Reader, c.writeHeaderBuf[:4])
+		_, err = io.ReadFull(c.maskRand, c.writeHeaderBuf[:4])
 		if err != nil {
 			return 0, fmt.Errorf("failed to generate masking key: %w", err)
 		}
@@ -302,17 +877,25 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		c.writeHeader.rsv1 = true
 	}
 
+	if c.onWriteFrame != nil {
+		c.onWriteFrame(c.writeHeader.trace())
+	}
+
 	err = writeFrameHeader(c.writeHeader, c.bw, c.writeHeaderBuf[:])
 	if err != nil {
 		return 0, err
 	}
 
 	n, err := c.writeFramePayload(p)
+	atomic.AddInt64(&c.stats.BytesWritten, int64(n))
 	if err != nil {
 		return n, err
 	}
+	if fin && opcode != opClose && opcode != opPing && opcode != opPong {
+		atomic.AddInt64(&c.stats.MessagesWritten, 1)
+	}
 
-	if c.writeHeader.fin {
+	if c.writeHeader.fin && !cork {
 		err = c.bw.Flush()
 		if err != nil {
 			return n, fmt.Errorf("failed to flush: %w", err)
@@ -392,6 +975,10 @@ func extractBufioWriterBuf(bw *bufio.Writer, w io.Writer) []byte {
 
 func (c *Conn) writeError(code StatusCode, err error) {
 	c.setCloseErr(err)
-	c.writeClose(code, err.Error())
+	reason := err.Error()
+	if c.closeReasonFunc != nil {
+		reason = truncateCloseReason(c.closeReasonFunc(code, err))
+	}
+	c.writeClose(context.Background(), code, reason)
 	c.close(nil)
 }
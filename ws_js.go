@@ -2,16 +2,19 @@ package websocket // import "nhooyr.io/websocket"
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"syscall/js"
+	"time"
 
 	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/wsjs"
@@ -109,7 +112,7 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 		return 0, nil, fmt.Errorf("failed to read: %w", err)
 	}
 	if int64(len(p)) > c.msgReadLimit.Load() {
-		err := fmt.Errorf("read limited at %v bytes", c.msgReadLimit.Load())
+		err := ReadLimitError{Limit: c.msgReadLimit.Load()}
 		c.Close(StatusMessageTooBig, err.Error())
 		return 0, nil, err
 	}
@@ -153,11 +156,77 @@ func (c *Conn) read(ctx context.Context) (MessageType, []byte, error) {
 	}
 }
 
+// ReadBuffer is like Read but reads the message into buf.
+// buf is reset before reading.
+func (c *Conn) ReadBuffer(ctx context.Context, buf *bytes.Buffer) (MessageType, error) {
+	typ, p, err := c.Read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	buf.Reset()
+	buf.Write(p)
+	return typ, nil
+}
+
+// ReadGzip is like Reader but for messages gzipped by the application.
+// The read limit applies to both the compressed and decompressed size of the message.
+func (c *Conn) ReadGzip(ctx context.Context) (MessageType, io.ReadCloser, error) {
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		err = fmt.Errorf("failed to read gzip header: %w", err)
+		c.Close(StatusInvalidFramePayloadData, err.Error())
+		return 0, nil, err
+	}
+
+	// One extra byte so that a message of exactly the limit reads to EOF.
+	return typ, &gzipReader{c: c, gr: gr, n: c.msgReadLimit.Load() + 1}, nil
+}
+
+type gzipReader struct {
+	c  *Conn
+	gr *gzip.Reader
+	n  int64
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		err := ReadLimitError{Limit: r.c.msgReadLimit.Load()}
+		r.c.Close(StatusMessageTooBig, err.Error())
+		return 0, err
+	}
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.gr.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func (r *gzipReader) Close() error {
+	return r.gr.Close()
+}
+
 // Ping is mocked out for Wasm.
 func (c *Conn) Ping(ctx context.Context) error {
 	return nil
 }
 
+// PingTimed is mocked out for Wasm.
+func (c *Conn) PingTimed(ctx context.Context) (time.Duration, error) {
+	return 0, nil
+}
+
+// PingPayload is mocked out for Wasm.
+func (c *Conn) PingPayload(ctx context.Context, p []byte) error {
+	return nil
+}
+
 // Write writes a message of the given type to the connection.
 // Always non blocking.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
@@ -175,18 +244,27 @@ func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
 	return nil
 }
 
+// WriteAndClose writes a final message and then closes the connection
+// with the given status code and reason.
+func (c *Conn) WriteAndClose(ctx context.Context, typ MessageType, p []byte, code StatusCode, reason string) error {
+	err := c.Write(ctx, typ, p)
+	if err != nil {
+		return err
+	}
+	return c.Close(code, reason)
+}
+
 func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) error {
 	if c.isClosed() {
 		return c.closeErr
 	}
-	switch typ {
-	case MessageBinary:
-		return c.ws.SendBytes(p)
-	case MessageText:
-		return c.ws.SendText(string(p))
-	default:
+	if !typ.valid() {
 		return fmt.Errorf("unexpected message type: %v", typ)
 	}
+	if typ == MessageBinary {
+		return c.ws.SendBytes(p)
+	}
+	return c.ws.SendText(string(p))
 }
 
 // Close closes the WebSocket with the given code and reason.
@@ -233,6 +311,33 @@ func (c *Conn) Subprotocol() string {
 	return c.ws.Subprotocol()
 }
 
+// Done returns a channel that is closed once the connection is closed.
+// Use it to react to the connection closing alongside other events.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// IsClosed reports whether the connection has been closed
+// without blocking or performing any I/O.
+func (c *Conn) IsClosed() bool {
+	return c.isClosed()
+}
+
+// Err returns the error the connection was closed with or nil if
+// the connection is still open.
+func (c *Conn) Err() error {
+	if c.isClosed() {
+		return c.closeErr
+	}
+	return nil
+}
+
+// OfferedSubprotocols is always nil for Wasm as it only
+// supports client connections.
+func (c *Conn) OfferedSubprotocols() []string {
+	return nil
+}
+
 // DialOptions represents the options available to pass to Dial.
 type DialOptions struct {
 	// Subprotocols lists the subprotocols to negotiate with the server.
@@ -360,6 +465,9 @@ func (c *Conn) CloseRead(ctx context.Context) context.Context {
 
 // SetReadLimit implements *Conn.SetReadLimit for wasm.
 func (c *Conn) SetReadLimit(n int64) {
+	if n < 0 {
+		n = math.MaxInt64 - 1
+	}
 	c.msgReadLimit.Store(n)
 }
 
@@ -2,38 +2,158 @@
 package wsjson // import "nhooyr.io/websocket/wsjson"
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/errd"
 )
 
+// Codec reads and writes JSON messages while reusing buffers and encoders
+// between calls to avoid allocations. The package level functions use
+// a shared Codec.
+//
+// Buffers that grew past 64 KiB for a large message are not reused so that
+// a single large message does not pin its memory in the Codec.
+//
+// The zero value is ready to use. A Codec is safe for concurrent use
+// and must not be copied after first use.
+type Codec struct {
+	buffers  sync.Pool
+	encoders sync.Pool
+}
+
+var defaultCodec Codec
+
+// maxPooledBufferSize is the capacity past which buffers are not reused.
+const maxPooledBufferSize = 64 << 10
+
+func (cd *Codec) getBuffer() *bytes.Buffer {
+	b, ok := cd.buffers.Get().(*bytes.Buffer)
+	if !ok {
+		b = &bytes.Buffer{}
+	}
+	return b
+}
+
+func (cd *Codec) putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	cd.buffers.Put(b)
+}
+
+// encoder is a json.Encoder bound to the buffer it encodes into.
+type encoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+func (cd *Codec) getEncoder() *encoder {
+	e, ok := cd.encoders.Get().(*encoder)
+	if !ok {
+		e = &encoder{}
+		e.enc = json.NewEncoder(&e.buf)
+	}
+	return e
+}
+
+func (cd *Codec) putEncoder(e *encoder) {
+	if e.buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	e.buf.Reset()
+	cd.encoders.Put(e)
+}
+
 // Read reads a JSON message from c into v.
 // It will reuse buffers in between calls to avoid allocations.
+//
+// Both text and binary messages are accepted as some peers send JSON
+// in binary messages. See ReadWithType to also get the message type.
 func Read(ctx context.Context, c *websocket.Conn, v interface{}) error {
-	return read(ctx, c, v)
+	return defaultCodec.Read(ctx, c, v)
 }
 
-func read(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
+// ReadWithType is like Read but also returns the type of the message
+// so that callers can branch on it.
+func ReadWithType(ctx context.Context, c *websocket.Conn, v interface{}) (websocket.MessageType, error) {
+	return defaultCodec.read(ctx, c, v)
+}
+
+// Read is like the package level Read but reuses buffers of cd.
+func (cd *Codec) Read(ctx context.Context, c *websocket.Conn, v interface{}) error {
+	_, err := cd.read(ctx, c, v)
+	return err
+}
+
+func (cd *Codec) read(ctx context.Context, c *websocket.Conn, v interface{}) (_ websocket.MessageType, err error) {
 	defer errd.Wrap(&err, "failed to read JSON message")
 
-	_, r, err := c.Reader(ctx)
+	typ, r, err := c.Reader(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	b := bpool.Get()
-	defer bpool.Put(b)
+	b := cd.getBuffer()
+	defer cd.putBuffer(b)
 
 	_, err = b.ReadFrom(r)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	err = json.Unmarshal(b.Bytes(), v)
+	if err != nil {
+		c.Close(websocket.StatusInvalidFramePayloadData, "failed to unmarshal JSON")
+		return 0, fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+
+	return typ, nil
+}
+
+// ReadStream reads a JSON text message from c into v.
+// Unlike Read, it decodes directly off the message as it is received
+// instead of first buffering the entire message. Prefer it for large
+// messages to avoid holding both the raw message and v in memory.
+//
+// If the message is not a text message, the connection is closed with
+// StatusUnsupportedData.
+func ReadStream(ctx context.Context, c *websocket.Conn, v interface{}) error {
+	return readStream(ctx, c, v)
+}
+
+func readStream(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
+	defer errd.Wrap(&err, "failed to read JSON message")
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return err
+	}
+
+	if typ != websocket.MessageText {
+		c.Close(websocket.StatusUnsupportedData, "expected text message")
+		return fmt.Errorf("expected text message for JSON but got: %v", typ)
+	}
+
+	d := json.NewDecoder(r)
+	err = d.Decode(v)
+	if err == nil {
+		// The message must be read to completion and contain
+		// nothing but whitespace after the value.
+		_, err = d.Token()
+		if err == nil {
+			err = errors.New("unexpected data after top-level value")
+		} else if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
 	if err != nil {
 		c.Close(websocket.StatusInvalidFramePayloadData, "failed to unmarshal JSON")
 		return fmt.Errorf("failed to unmarshal JSON: %w", err)
@@ -45,23 +165,24 @@ func read(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
 // Write writes the JSON message v to c.
 // It will reuse buffers in between calls to avoid allocations.
 func Write(ctx context.Context, c *websocket.Conn, v interface{}) error {
-	return write(ctx, c, v)
+	return defaultCodec.Write(ctx, c, v)
 }
 
-func write(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
+// Write is like the package level Write but reuses the buffers and
+// encoders of cd.
+func (cd *Codec) Write(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
 	defer errd.Wrap(&err, "failed to write JSON message")
 
-	w, err := c.Writer(ctx, websocket.MessageText)
-	if err != nil {
-		return err
-	}
-
 	// json.Marshal cannot reuse buffers between calls as it has to return
-	// a copy of the byte slice but Encoder does as it directly writes to w.
-	err = json.NewEncoder(w).Encode(v)
+	// a copy of the byte slice but an Encoder writing into a pooled
+	// buffer does. Nothing is written if v fails to marshal.
+	e := cd.getEncoder()
+	defer cd.putEncoder(e)
+
+	err = e.enc.Encode(v)
 	if err != nil {
 		return fmt.Errorf("failed to marshal JSON: %w", err)
 	}
 
-	return w.Close()
+	return c.Write(ctx, websocket.MessageText, e.buf.Bytes())
 }